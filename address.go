@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fastjson"
+)
+
+type addressDate struct {
+	Source   string       `json:"source"`
+	Postcode *addressPart `json:"postcode,omitempty"`
+	Region   *addressPart `json:"region,omitempty"`
+	District *addressPart `json:"district,omitempty"`
+	Locality *addressPart `json:"locality,omitempty"`
+	Street   *addressPart `json:"street,omitempty"`
+	House    *addressPart `json:"house,omitempty"`
+	Building *addressPart `json:"building,omitempty"`
+	Flat     *addressPart `json:"flat,omitempty"`
+}
+
+type addressPart struct {
+	Value      string  `json:"value"`
+	Type       string  `json:"type,omitempty"`
+	ID         int     `json:"id,omitempty"`
+	Title      string  `json:"title,omitempty"`
+	Confidence float64 `json:"confidence"`
+}
+
+var (
+	houseNames    = numberNames(houseTypes)
+	buildingNames = numberNames(buildingTypes)
+	flatNames     = numberNames(flatTypes)
+
+	addressPostcodeRegex = regexp.MustCompile(`^\d{6}$`)
+	addressNumberRegex   = regexp.MustCompile(`^\d+\S*$`)
+	addressHouseRegex    = regexp.MustCompile(`^(\S+?)\s*(к|корп|корпус|стр|строение)\.?\s*(\S+)$`)
+)
+
+func postAddressParse(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	source := fastjson.GetString(ctx.PostBody(), "address")
+	if len(source) == 0 {
+		source = string(ctx.PostBody())
+	}
+	addressDate, err := parseAddress(source)
+	if err != nil {
+		searchFailed(ctx, err)
+		return
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Address: ", source, "; Time Spent: ", time.Since(start))
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(addressDate)
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+// addressType splits "Тюменская обл" or "ул. Республики" into the name and the abbreviation.
+func addressType(part string) (string, string) {
+	words := strings.Fields(strings.Replace(part, ".", ". ", -1))
+	if len(words) < 2 {
+		return part, ""
+	}
+	first := strings.TrimSuffix(words[0], ".")
+	last := strings.TrimSuffix(words[len(words)-1], ".")
+	if abbr := knownType(first); len(abbr) > 0 {
+		return strings.Join(words[1:], " "), abbr
+	}
+	if abbr := knownType(last); len(abbr) > 0 {
+		return strings.Join(words[:len(words)-1], " "), abbr
+	}
+	return part, ""
+}
+
+// addressLevels caches the types of regions and districts found in the index, a failed load is
+// cached as well and the index is asked again after levelRetry.
+var addressLevels struct {
+	sync.Mutex
+	loaded   bool
+	region   []string
+	district []string
+	err      error
+	failedAt time.Time
+}
+
+const levelRetry = time.Minute
+
+// levelTypes returns the region and district types: the types of the region documents that no
+// region child has (so "г" of Москва stays a locality) and the types of the region children that
+// localityTypes doesn't have, like "р-н". The lists are loaded from the index once, the lock is not
+// held while the index is asked.
+func levelTypes() ([]string, []string, error) {
+	addressLevels.Lock()
+	loaded, region, district := addressLevels.loaded, addressLevels.region, addressLevels.district
+	err, failedAt := addressLevels.err, addressLevels.failedAt
+	addressLevels.Unlock()
+	if loaded {
+		return region, district, nil
+	}
+	if err != nil && time.Since(failedAt) < levelRetry {
+		return nil, nil, err
+	}
+	region, district, err = loadLevelTypes()
+	addressLevels.Lock()
+	defer addressLevels.Unlock()
+	if err != nil {
+		addressLevels.err, addressLevels.failedAt = err, time.Now()
+		return nil, nil, err
+	}
+	addressLevels.region, addressLevels.district, addressLevels.loaded = region, district, true
+	return region, district, nil
+}
+
+func loadLevelTypes() ([]string, []string, error) {
+	resp, err := sendRequest(indexKladr, queryRegions())
+	if err != nil {
+		return nil, nil, err
+	}
+	var regionIDs []int
+	regionTitles := make(map[string]bool)
+	for _, hit := range resp.Hits.Hits {
+		regionIDs = append(regionIDs, fastjson.GetInt(hit.Source, "doc_id"))
+		regionTitles[fastjson.GetString(hit.Source, "locality_title")] = true
+	}
+	childTitles := make(map[string]bool)
+	if len(regionIDs) > 0 {
+		resp, err = sendRequest(indexKladr, queryRegionChildren(regionIDs))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, hit := range resp.Hits.Hits {
+			childTitles[fastjson.GetString(hit.Source, "locality_title")] = true
+		}
+	}
+	var region, district []string
+	for title := range regionTitles {
+		if len(title) > 0 && !childTitles[title] {
+			region = append(region, title)
+		}
+	}
+	for title := range childTitles {
+		if len(title) > 0 && !regionTitles[title] && !isLocalityType(title) {
+			district = append(district, title)
+		}
+	}
+	sort.Strings(region)
+	sort.Strings(district)
+	return region, district, nil
+}
+
+// isLocalityType reports an abbreviation of localityTypes.
+func isLocalityType(abbr string) bool {
+	for i := 0; i+1 < len(localityTypes); i += 2 {
+		if abbr == localityTypes[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// numberNames maps both the words and the abbreviations of houseTypes, buildingTypes or flatTypes to the word.
+func numberNames(pairs []string) map[string]string {
+	names := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		names[pairs[i]] = pairs[i]
+		if _, ok := names[pairs[i+1]]; !ok {
+			names[pairs[i+1]] = pairs[i]
+		}
+	}
+	return names
+}
+
+// knownType maps both abbreviations and full names from localityTypes, the index levels (named by
+// typeNames) and streetTypes to the abbreviation, an unknown word is not a type. A failed load of
+// the levels is reported by the callers of levelTypes, here only the levels already known are used.
+func knownType(word string) string {
+	for i := 0; i+1 < len(localityTypes); i += 2 {
+		if word == localityTypes[i] || strings.EqualFold(word, localityTypes[i+1]) {
+			return localityTypes[i]
+		}
+	}
+	lower := strings.ToLower(word)
+	regionTypes, districtTypes, _ := levelTypes()
+	for _, v := range append(regionTypes, districtTypes...) {
+		if lower == strings.ToLower(v) || lower == typeNames[v] {
+			return v
+		}
+	}
+	for abbr, name := range streetTypes {
+		if lower == abbr || lower == name {
+			return abbr
+		}
+	}
+	for _, names := range []map[string]string{houseNames, buildingNames, flatNames} {
+		if _, ok := names[lower]; ok {
+			return lower
+		}
+	}
+	return ""
+}
+
+func containsType(types []string, abbr string) bool {
+	for _, v := range types {
+		if v == abbr {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddress splits the address into components and links them to index documents.
+func parseAddress(source string) (addressDate, error) {
+	var addressDate addressDate
+	addressDate.Source = source
+	regionTypes, districtTypes, err := levelTypes()
+	if err != nil {
+		return addressDate, err
+	}
+	for _, part := range strings.Split(source, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		if addressPostcodeRegex.MatchString(part) {
+			addressDate.Postcode = &addressPart{Value: part, Confidence: 1}
+			continue
+		}
+		name, abbr := addressType(part)
+		_, isStreet := streetTypes[abbr]
+		_, isHouse := houseNames[abbr]
+		_, isBuilding := buildingNames[abbr]
+		_, isFlat := flatNames[abbr]
+		// "д" is both a village and a house, it is a house once the street or the locality is known
+		if abbr == "д" && addressDate.Locality == nil && !addressNumberRegex.MatchString(name) {
+			isHouse = false
+		}
+		switch {
+		case containsType(regionTypes, abbr):
+			addressDate.Region = &addressPart{Value: name, Type: abbr}
+		case containsType(districtTypes, abbr):
+			addressDate.District = &addressPart{Value: name, Type: abbr}
+		case isStreet:
+			addressDate.Street = &addressPart{Value: name, Type: abbr}
+		case isHouse:
+			addressDate.House = &addressPart{Value: name, Type: abbr}
+			if res := addressHouseRegex.FindStringSubmatch(name); len(res) == 4 {
+				addressDate.House.Value = res[1]
+				addressDate.Building = &addressPart{Value: res[3], Type: knownType(res[2]), Confidence: 1}
+			}
+		case isBuilding:
+			addressDate.Building = &addressPart{Value: name, Type: abbr, Confidence: 1}
+		case isFlat:
+			addressDate.Flat = &addressPart{Value: name, Type: abbr, Confidence: 1}
+		case len(abbr) > 0:
+			addressDate.Locality = &addressPart{Value: name, Type: abbr}
+		case addressNumberRegex.MatchString(part) && addressDate.Street != nil && addressDate.House == nil:
+			addressDate.House = &addressPart{Value: part}
+		case addressNumberRegex.MatchString(part) && addressDate.House != nil && addressDate.Flat == nil:
+			addressDate.Flat = &addressPart{Value: part, Confidence: 0.5}
+		case addressDate.Locality == nil:
+			addressDate.Locality = &addressPart{Value: part}
+		case addressDate.Street == nil:
+			addressDate.Street = &addressPart{Value: part}
+		}
+	}
+	err = matchAddress(&addressDate)
+	return addressDate, err
+}
+
+// matchAddress links parsed components to index documents, confidence drops for a missing type,
+// a name that only partly matches and for several equally good candidates.
+func matchAddress(addressDate *addressDate) error {
+	var err error
+	regionID := 0
+	if addressDate.Region != nil {
+		if regionID, err = matchPart(addressDate.Region, esTerm{"region_id", 0}); err != nil {
+			return err
+		}
+	}
+	var regionFilter []esClause
+	if regionID != 0 {
+		regionFilter = []esClause{esTerm{"region_id", regionID}}
+	}
+	districtID := 0
+	if addressDate.District != nil {
+		if districtID, err = matchPart(addressDate.District, regionFilter...); err != nil {
+			return err
+		}
+	}
+	localityID := 0
+	if addressDate.Locality != nil {
+		localityFilter := regionFilter
+		if districtID != 0 {
+			localityFilter = []esClause{esTerm{"parent_id", districtID}}
+		}
+		if localityID, err = matchPart(addressDate.Locality, localityFilter...); err != nil {
+			return err
+		}
+		if localityID == 0 && districtID != 0 {
+			if localityID, err = matchPart(addressDate.Locality, regionFilter...); err != nil {
+				return err
+			}
+		}
+	}
+	streetID := 0
+	if addressDate.Street != nil && localityID != 0 {
+		resp, err := sendRequest(indexStreet, queryParse("street_name", addressDate.Street.Value, esTerm{"locality_id", localityID}))
+		if err != nil {
+			return err
+		}
+		streetDates := resultStreetFromHits(resp)
+		if len(streetDates) > 0 {
+			addressDate.Street.ID = streetDates[0].ID
+			addressDate.Street.Title = streetDates[0].FullName
+			addressDate.Street.Confidence = partConfidence(addressDate.Street, streetDates[0].StreetType.LocalityName, getStreetReplace(addressDate.Street.Type) == streetDates[0].StreetType.LocalityTitle, len(streetDates))
+			streetID = streetDates[0].ID
+		}
+	}
+	if addressDate.House != nil && streetID != 0 {
+		house := addressDate.House.Value
+		if addressDate.Building != nil {
+			house = house + addressDate.Building.Type + addressDate.Building.Value
+		}
+		resp, err := sendRequest(indexHouse, queryHouse(streetID))
+		if err != nil {
+			return err
+		}
+		for _, hit := range resp.Hits.Hits {
+			if matchHouseBlock(fastjson.GetString(hit.Source, "houses"), fastjson.GetString(hit.Source, "korp"), house) {
+				addressDate.House.Confidence = 1
+				if addressDate.Postcode == nil && len(fastjson.GetString(hit.Source, "postcode")) > 0 {
+					addressDate.Postcode = &addressPart{Value: fastjson.GetString(hit.Source, "postcode"), Confidence: 0.9}
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func matchPart(part *addressPart, filters ...esClause) (int, error) {
+	resp, err := sendRequest(indexKladr, queryParse("locality_name", part.Value, filters...))
+	if err != nil {
+		return 0, err
+	}
+	docDates := resultFromHits(resp)
+	if len(docDates) == 0 {
+		return 0, nil
+	}
+	best := 0
+	for i, v := range docDates {
+		if len(part.Type) > 0 && fullTypeName(part.Type) == v.LocalityType.LocalityTitle {
+			best = i
+			break
+		}
+	}
+	part.ID = docDates[best].ID
+	part.Title = docDates[best].FullName
+	part.Confidence = partConfidence(part, docDates[best].LocalityType.LocalityName, len(part.Type) > 0 && fullTypeName(part.Type) == docDates[best].LocalityType.LocalityTitle, len(docDates))
+	return part.ID, nil
+}
+
+func partConfidence(part *addressPart, name string, typeMatched bool, count int) float64 {
+	confidence := 1.0
+	if !strings.EqualFold(part.Value, name) {
+		confidence = confidence * 0.8
+	}
+	if !typeMatched {
+		confidence = confidence * 0.8
+	}
+	if count > 1 {
+		confidence = confidence * 0.9
+	}
+	return float64(int(confidence*100)) / 100
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func addressFixture(t *testing.T) Searcher {
+	t.Helper()
+	memory, err := newMemorySearcher(map[string]string{
+		indexKladr:  "testdata/memory/kladr.jsonl",
+		indexStreet: "testdata/memory/street.jsonl",
+		indexHouse:  "testdata/memory/house.jsonl",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := searcher
+	searcher = memory
+	addressLevels.loaded, addressLevels.err = false, nil
+	return previous
+}
+
+// partString gives "type value #id" of a component, "" when the component is missing.
+func partString(part *addressPart) string {
+	if part == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %s #%d", part.Type, part.Value, part.ID)
+}
+
+func TestParseAddress(t *testing.T) {
+	rowCount = 10
+	defer func(previous Searcher) { searcher = previous }(addressFixture(t))
+	tests := []struct {
+		source   string
+		postcode string
+		region   string
+		district string
+		locality string
+		street   string
+		house    string
+		building string
+		flat     string
+	}{
+		{"625003, Тюменская обл, г Тюмень, ул Ленина, д 5, кв 12", " 625003 #0", "обл Тюменская #1", "", "г Тюмень #2", "ул Ленина #11", "д 5 #0", "", "кв 12 #0"},
+		// without types the order decides and the postcode comes from the house block
+		{"Тюмень, Ленина, 5, 12", " 625003 #0", "", "", " Тюмень #2", " Ленина #11", " 5 #0", "", " 12 #0"},
+		// full names of the types, "район" is the district level of the index
+		{"Тюменская область, Тюменский район, село Нижняя Тавда", "", "обл Тюменская #1", "р-н Тюменский #7", "с Нижняя Тавда #9", "", "", "", ""},
+		// "д" before the locality is a village
+		{"обл Тюменская, р-н Тюменский, д Тюменцево", "", "обл Тюменская #1", "р-н Тюменский #7", "д Тюменцево #4", "", "", "", ""},
+		// "г" of Москва is a locality, the street is not in the index
+		{"г Москва, ул Тверская, дом 1 корп 2", "", "", "", "г Москва #5", "ул Тверская #0", "дом 1 #0", "корп 2 #0", ""},
+		// the street is looked up in the matched locality only
+		{"Адыгея Респ, г Майкоп, ул Ленина, д 3 стр 1, оф 4", "", "Респ Адыгея #8", "", "г Майкоп #6", "ул Ленина #0", "д 3 #0", "стр 1 #0", "оф 4 #0"},
+		{"г. Тюмень, ул. Республики, д. 7к2", "", "", "", "г Тюмень #2", "ул Республики #12", "д 7 #0", "к 2 #0", ""},
+		// an unknown abbreviation stays in the name
+		{"дер Ивановка", "", "", "", " дер Ивановка #0", "", "", "", ""},
+	}
+	for _, test := range tests {
+		got, err := parseAddress(test.source)
+		if err != nil {
+			t.Errorf("parseAddress(%q): %v", test.source, err)
+			continue
+		}
+		want := []string{test.postcode, test.region, test.district, test.locality, test.street, test.house, test.building, test.flat}
+		for i, part := range []*addressPart{got.Postcode, got.Region, got.District, got.Locality, got.Street, got.House, got.Building, got.Flat} {
+			if partString(part) != want[i] {
+				t.Errorf("parseAddress(%q): component %d is %q, want %q", test.source, i, partString(part), want[i])
+			}
+		}
+	}
+}
+
+// failingSearcher counts the searches and fails all of them.
+type failingSearcher struct {
+	calls *int
+}
+
+func (searcher failingSearcher) Search(index string, query esSearch) (searchResponse, error) {
+	*searcher.calls++
+	return searchResponse{}, errors.New("search failed")
+}
+
+func (searcher failingSearcher) Ping() error {
+	return nil
+}
+
+func TestLevelTypesCachesFailure(t *testing.T) {
+	defer func(previous Searcher) { searcher = previous }(searcher)
+	calls := 0
+	searcher = failingSearcher{&calls}
+	addressLevels.loaded, addressLevels.err = false, nil
+	for i := 0; i < 3; i++ {
+		if _, err := parseAddress("г Тюмень"); err == nil {
+			t.Fatal("parseAddress: no error with a failing index")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("%d searches, want 1 until levelRetry passes", calls)
+	}
+	addressLevels.failedAt = time.Now().Add(-levelRetry)
+	if _, _, err := levelTypes(); err == nil || calls != 2 {
+		t.Errorf("after levelRetry: %d searches and error %v, want 2 and an error", calls, err)
+	}
+	addressLevels.loaded, addressLevels.err = false, nil
+}
@@ -0,0 +1,172 @@
+// Package bulk sends the documents of the importers to Elasticsearch with the _bulk API.
+package bulk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Indexer queues documents of one index and sends them in batches limited by the number of
+// documents (env BULK_SIZE, 500 by default) and the size of the request (env BULK_BYTES, 5 MB by default).
+type Indexer struct {
+	url      string
+	client   *resty.Client
+	maxDocs  int
+	maxBytes int
+	body     bytes.Buffer
+	queued   int
+	Indexed  int
+	Failed   int
+}
+
+var (
+	defaults     = make(map[string]*Indexer)
+	defaultsLock sync.Mutex
+)
+
+// Default returns the indexer of the index url, made on the first call, so the importers share
+// the lazy setup and Close sends whatever is left at the end of a run.
+func Default(url string) *Indexer {
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
+	indexer, ok := defaults[url]
+	if !ok {
+		indexer = New(url)
+		defaults[url] = indexer
+	}
+	return indexer
+}
+
+// Close closes the Default indexers, the error is the last one of them.
+func Close() error {
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
+	var err error
+	for url, indexer := range defaults {
+		if e := indexer.Close(); e != nil {
+			err = e
+		}
+		delete(defaults, url)
+	}
+	return err
+}
+
+func New(url string) *Indexer {
+	indexer := &Indexer{url: url, client: resty.New(), maxDocs: 500, maxBytes: 5 << 20}
+	if len(os.Getenv("BULK_SIZE")) > 0 {
+		size, err := strconv.Atoi(os.Getenv("BULK_SIZE"))
+		if err != nil || size <= 0 {
+			log.Panic("Env BULK_SIZE must by positive int")
+		}
+		indexer.maxDocs = size
+	}
+	if len(os.Getenv("BULK_BYTES")) > 0 {
+		size, err := strconv.Atoi(os.Getenv("BULK_BYTES"))
+		if err != nil || size <= 0 {
+			log.Panic("Env BULK_BYTES must by positive int")
+		}
+		indexer.maxBytes = size
+	}
+	return indexer
+}
+
+// Index queues the document under the id with the index action, so a run of an import replaces
+// the whole document and a field the import no longer writes disappears with it. A document
+// without an id is only added. The error is the one of a batch sent on the way.
+func (indexer *Indexer) Index(id string, doc []byte) error {
+	if len(id) == 0 {
+		return indexer.queue([]byte(`{"index":{}}`), doc)
+	}
+	action, _ := json.Marshal(map[string]map[string]string{"index": {"_id": id}})
+	return indexer.queue(action, doc)
+}
+
+// Update queues a partial update of the document with the id: the fields of doc are written, the
+// rest is kept. A missing document is not created, its item fails and is counted in Failed.
+func (indexer *Indexer) Update(id string, doc []byte) error {
+	action, _ := json.Marshal(map[string]map[string]string{"update": {"_id": id}})
+	body := make([]byte, 0, len(doc)+8)
+	body = append(body, `{"doc":`...)
+	body = append(body, doc...)
+	body = append(body, '}')
+	return indexer.queue(action, body)
+}
+
+func (indexer *Indexer) queue(action []byte, doc []byte) error {
+	var err error
+	if indexer.body.Len() > 0 && indexer.body.Len()+len(action)+len(doc)+2 > indexer.maxBytes {
+		err = indexer.Flush()
+	}
+	indexer.body.Write(action)
+	indexer.body.WriteByte('\n')
+	indexer.body.Write(doc)
+	indexer.body.WriteByte('\n')
+	indexer.queued++
+	if indexer.queued >= indexer.maxDocs {
+		err = indexer.Flush()
+	}
+	return err
+}
+
+// Flush sends the queued documents. Items rejected by Elasticsearch are logged with their ids and
+// counted in Failed, the error is returned only when the whole batch is lost.
+func (indexer *Indexer) Flush() error {
+	count := indexer.queued
+	if count == 0 {
+		return nil
+	}
+	defer func() {
+		indexer.body.Reset()
+		indexer.queued = 0
+	}()
+	resp, err := indexer.client.R().SetHeader("Content-Type", "application/x-ndjson").SetBody(indexer.body.Bytes()).Post(indexer.url + "/_bulk")
+	if err != nil {
+		indexer.Failed += count
+		return err
+	}
+	if resp.StatusCode() != 200 {
+		indexer.Failed += count
+		return fmt.Errorf("Bulk request of %d documents failed: %d %s", count, resp.StatusCode(), resp.Body())
+	}
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(resp.Body(), &result); err != nil {
+		indexer.Failed += count
+		return err
+	}
+	indexer.Indexed += count
+	if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for _, v := range item {
+			if v.Error == nil {
+				continue
+			}
+			indexer.Indexed--
+			indexer.Failed++
+			log.Print("Document ", v.ID, " not indexed: ", v.Status, " ", string(v.Error))
+		}
+	}
+	return nil
+}
+
+// Close sends the rest of the queue and logs the totals of the run.
+func (indexer *Indexer) Close() error {
+	err := indexer.Flush()
+	log.Print("Documents indexed: ", indexer.Indexed, ", failed: ", indexer.Failed)
+	return err
+}
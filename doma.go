@@ -0,0 +1,103 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	houseRangeRegex  = regexp.MustCompile(`^([нч]?)\(?(\d+)-(\d+)\)?$`)
+	houseNumberRegex = regexp.MustCompile(`^(\d+)(.*)$`)
+	housePrefixRegex = regexp.MustCompile(`^(дом|д)(\d)`)
+	houseWords       = strings.NewReplacer(append(append(append(houseTypes, buildingTypes...), flatTypes...), " ", "", ".", "")...)
+)
+
+// Words of house, building and flat numbers paired with the abbreviations DOMA names use, longer
+// words go first so "домовладение" is not shortened as "дом".
+var (
+	houseTypes    = []string{"домовладение", "двлд", "владение", "влд", "дом", "д"}
+	buildingTypes = []string{"корпус", "к", "корп", "к", "строение", "стр", "литера", "лит"}
+	flatTypes     = []string{"квартира", "кв", "офис", "оф", "помещение", "пом"}
+)
+
+func normalizeHouse(a string) string {
+	a = strings.ToLower(strings.TrimSpace(a))
+	a = houseWords.Replace(a)
+	return housePrefixRegex.ReplaceAllString(a, "$2")
+}
+
+// korpSuffix is the normalized building of a DOMA KORP, a bare number is a korpus: "2" is "к2".
+func korpSuffix(korp string) string {
+	korp = normalizeHouse(korp)
+	if len(korp) > 0 && korp[0] >= '0' && korp[0] <= '9' {
+		return "к" + korp
+	}
+	return korp
+}
+
+func houseNumber(a string) (int, string, bool) {
+	res := houseNumberRegex.FindStringSubmatch(a)
+	if len(res) != 3 {
+		return 0, "", false
+	}
+	number, err := strconv.Atoi(res[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return number, res[2], true
+}
+
+// matchHouseBlock checks a house against a DOMA name like "1,3,5к1,Н(7-19),Ч(2-40),50-60" and its
+// KORP. Ranges compare only the leading number, so "12к2" is inside "Ч(2-40)". With KORP "2" the
+// block holds only that building: "1,3" means "1к2" and "3к2", not "1".
+func matchHouseBlock(block string, korp string, house string) bool {
+	house = normalizeHouse(house)
+	if building := korpSuffix(korp); len(building) > 0 {
+		if !strings.HasSuffix(house, building) {
+			return false
+		}
+		house = strings.TrimSuffix(house, building)
+	}
+	if len(house) == 0 {
+		return false
+	}
+	number, _, isNumber := houseNumber(house)
+	for _, item := range strings.Split(block, ",") {
+		item = normalizeHouse(item)
+		if len(item) == 0 {
+			continue
+		}
+		if item == house {
+			return true
+		}
+		if !isNumber {
+			continue
+		}
+		if item == "н" && number%2 == 1 || item == "ч" && number%2 == 0 {
+			return true
+		}
+		res := houseRangeRegex.FindStringSubmatch(item)
+		if len(res) != 4 {
+			continue
+		}
+		from, _ := strconv.Atoi(res[2])
+		to, _ := strconv.Atoi(res[3])
+		if number < from || number > to {
+			continue
+		}
+		switch res[1] {
+		case "н":
+			if number%2 == 1 {
+				return true
+			}
+		case "ч":
+			if number%2 == 0 {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
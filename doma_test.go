@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestMatchHouseBlock(t *testing.T) {
+	tests := []struct {
+		block string
+		korp  string
+		house string
+		want  bool
+	}{
+		{"1,3,5к1,Н(7-19),Ч(2-40),50-60", "", "5 корп. 1", true},
+		{"1,3,5к1,Н(7-19),Ч(2-40),50-60", "", "5", false},
+		{"1,3,5к1,Н(7-19),Ч(2-40),50-60", "", "9", true},
+		{"1,3,5к1,Н(7-19),Ч(2-40),50-60", "", "21", false},
+		{"1,3,5к1,Н(7-19),Ч(2-40),50-60", "", "12к2", true},
+		{"1,3,5к1,Н(7-19),Ч(2-40),50-60", "", "55", true},
+		{"1,3,5к1,Н(7-19),Ч(2-40),50-60", "", "дом 3", true},
+		// the block with KORP holds only the houses of that building
+		{"1,3", "2", "1к2", true},
+		{"1,3", "2", "3 корпус 2", true},
+		{"1,3", "2", "1", false},
+		{"1,3", "2", "1к1", false},
+		{"Ч(2-40)", "1", "12к1", true},
+		{"Ч(2-40)", "1", "13к1", false},
+		{"5", "стр 3", "5 строение 3", true},
+		{"5", "стр 3", "5", false},
+	}
+	for _, test := range tests {
+		if got := matchHouseBlock(test.block, test.korp, test.house); got != test.want {
+			t.Errorf("matchHouseBlock(%q, %q, %q) = %v, want %v", test.block, test.korp, test.house, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type ipgeobaseCity struct {
+	City     string
+	Region   string
+	District string
+	Lat      string
+	Lon      string
+}
+
+// cp1251 maps bytes 0x80-0xFF of the Windows Cyrillic code page to runes, 0x98 is unused.
+var cp1251 = []rune("ЂЃ‚ѓ„…†‡€‰Љ‹ЊЌЋЏђ‘’“”•–—�™љ›њќћџ" +
+	"\u00a0ЎўЈ¤Ґ¦§Ё©Є«¬\u00ad®Ї°±Ііґµ¶·ё№є»јЅѕї" +
+	"АБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯабвгдежзийклмнопрстуфхцчшщъыьэюя")
+
+func decodeCP1251(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c < 0x80 {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteRune(cp1251[c-0x80])
+		}
+	}
+	return sb.String()
+}
+
+// getIpgeobaseData reads the ipgeobase.ru archive: cidr_optim.txt holds the ranges
+// ("start\tend\ta.b.c.d - e.f.g.h\tRU\tcity_id") and cities.txt the cities they point to.
+func getIpgeobaseData(url string, path string) {
+	cities := make(map[string]ipgeobaseCity)
+	err := walkGeoFile(path, "cities.txt", func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fields := strings.Split(decodeCP1251(scanner.Bytes()), "\t")
+			if len(fields) < 6 {
+				continue
+			}
+			cities[fields[0]] = ipgeobaseCity{City: fields[1], Region: fields[2], District: fields[3], Lat: fields[4], Lon: fields[5]}
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	log.Print("ipgeobase cities loaded: ", len(cities))
+	id := 0
+	err = walkGeoFile(path, "cidr_optim.txt", func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fields := strings.Split(decodeCP1251(scanner.Bytes()), "\t")
+			if len(fields) < 5 {
+				continue
+			}
+			docDate := docDate{}
+			var err error
+			docDate.StartIP, docDate.EndIP, err = blockToRange(fields[2])
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			id++
+			docDate.ID = id
+			docDate.Country = fields[3]
+			if city, ok := cities[fields[4]]; ok {
+				docDate.City = city.City
+				docDate.Region = city.Region
+				docDate.District = city.District
+				docDate.Location = geoLocation(city.Lat, city.Lon)
+			}
+			if err = addGeoDoc(docDate, url); err != nil {
+				log.Print(err)
+			}
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// walkGeoFile calls fn for the file with the given base name in a folder or a zip archive,
+// MaxMind archives keep their files in a dated subfolder.
+func walkGeoFile(path string, name string, fn func(r io.Reader) error) error {
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			if !strings.EqualFold(filepath.Base(file.Name), name) {
+				continue
+			}
+			log.Print("Read ", file.Name)
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return fn(r)
+		}
+		return errors.New("File " + name + " not found in " + path)
+	}
+	var found string
+	err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 && !info.IsDir() && strings.EqualFold(info.Name(), name) {
+			found = filePath
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return errors.New("File " + name + " not found in " + path)
+	}
+	log.Print("Read ", found)
+	r, err := os.Open(found)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(r)
+}
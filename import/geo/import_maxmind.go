@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"strconv"
+)
+
+type maxmindLocation struct {
+	Country string
+	Region  string
+	City    string
+	Lat     string
+	Lon     string
+}
+
+type mmdbReader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+// getMaxmindCsvData reads GeoLite2-City-Blocks-IPv4/IPv6.csv and takes names from
+// GeoLite2-City-Locations-<locale>.csv, English names fill the gaps.
+func getMaxmindCsvData(url string, path string, locale string) {
+	locations := make(map[string]maxmindLocation)
+	for _, v := range []string{"en", locale} {
+		err := walkGeoFile(path, "GeoLite2-City-Locations-"+v+".csv", func(r io.Reader) error {
+			return readMaxmindCsv(r, func(row map[string]string) error {
+				location := locations[row["geoname_id"]]
+				location.Country = row["country_iso_code"]
+				if len(row["subdivision_1_name"]) > 0 {
+					location.Region = row["subdivision_1_name"]
+				}
+				if len(row["city_name"]) > 0 {
+					location.City = row["city_name"]
+				}
+				locations[row["geoname_id"]] = location
+				return nil
+			})
+		})
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	log.Print("MaxMind locations loaded: ", len(locations))
+	id := 0
+	for _, v := range []string{"GeoLite2-City-Blocks-IPv4.csv", "GeoLite2-City-Blocks-IPv6.csv"} {
+		err := walkGeoFile(path, v, func(r io.Reader) error {
+			return readMaxmindCsv(r, func(row map[string]string) error {
+				docDate := docDate{}
+				var err error
+				docDate.StartIP, docDate.EndIP, err = blockToRange(row["network"])
+				if err != nil {
+					log.Print(err)
+					return nil
+				}
+				geonameID := row["geoname_id"]
+				if len(geonameID) == 0 {
+					geonameID = row["registered_country_geoname_id"]
+				}
+				location := locations[geonameID]
+				id++
+				docDate.ID = id
+				docDate.Country = location.Country
+				docDate.Region = location.Region
+				docDate.City = location.City
+				docDate.Location = geoLocation(row["latitude"], row["longitude"])
+				if err = addGeoDoc(docDate, url); err != nil {
+					log.Print(err)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+}
+
+func readMaxmindCsv(r io.Reader, fn func(row map[string]string) error) error {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	header = append([]string(nil), header...)
+	row := make(map[string]string, len(header))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, name := range header {
+			if i < len(record) {
+				row[name] = record[i]
+			} else {
+				row[name] = ""
+			}
+		}
+		if err = fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// getMmdbData walks every network of a GeoLite2-City.mmdb search tree, see
+// https://maxmind.github.io/MaxMind-DB/ for the format.
+func getMmdbData(url string, path string, locale string) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	reader, err := newMmdbReader(buf)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	locations := make(map[uint]maxmindLocation)
+	id := 0
+	err = reader.networks(func(start net.IP, end net.IP, offset uint) error {
+		location, ok := locations[offset]
+		if !ok {
+			record, _, err := reader.decode(offset)
+			if err != nil {
+				return err
+			}
+			location = mmdbLocation(record, locale)
+			locations[offset] = location
+		}
+		id++
+		docDate := docDate{}
+		docDate.ID = id
+		docDate.StartIP = start.String()
+		docDate.EndIP = end.String()
+		docDate.Country = location.Country
+		docDate.Region = location.Region
+		docDate.City = location.City
+		docDate.Location = geoLocation(location.Lat, location.Lon)
+		if err := addGeoDoc(docDate, url); err != nil {
+			log.Print(err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func mmdbLocation(record interface{}, locale string) maxmindLocation {
+	var location maxmindLocation
+	location.Country, _ = mmdbPath(record, "country", "iso_code").(string)
+	if len(location.Country) == 0 {
+		location.Country, _ = mmdbPath(record, "registered_country", "iso_code").(string)
+	}
+	location.City = mmdbName(mmdbPath(record, "city", "names"), locale)
+	if subdivisions, ok := mmdbPath(record, "subdivisions").([]interface{}); ok && len(subdivisions) > 0 {
+		location.Region = mmdbName(mmdbPath(subdivisions[0], "names"), locale)
+	}
+	if lat, ok := mmdbPath(record, "location", "latitude").(float64); ok {
+		location.Lat = strconv.FormatFloat(lat, 'f', -1, 64)
+	}
+	if lon, ok := mmdbPath(record, "location", "longitude").(float64); ok {
+		location.Lon = strconv.FormatFloat(lon, 'f', -1, 64)
+	}
+	return location
+}
+
+func mmdbPath(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func mmdbName(names interface{}, locale string) string {
+	if name, ok := mmdbPath(names, locale).(string); ok && len(name) > 0 {
+		return name
+	}
+	name, _ := mmdbPath(names, "en").(string)
+	return name
+}
+
+func newMmdbReader(buf []byte) (*mmdbReader, error) {
+	marker := []byte("\xab\xcd\xefMaxMind.com")
+	start := bytes.LastIndex(buf, marker)
+	if start == -1 {
+		return nil, errors.New("MMDB metadata not found")
+	}
+	reader := &mmdbReader{buf: buf, data: buf[start+len(marker):]}
+	metadata, _, err := reader.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	nodeCount, _ := mmdbPath(metadata, "node_count").(uint64)
+	recordSize, _ := mmdbPath(metadata, "record_size").(uint64)
+	ipVersion, _ := mmdbPath(metadata, "ip_version").(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, errors.New("Unsupported MMDB record size " + strconv.FormatUint(recordSize, 10))
+	}
+	reader.nodeCount = uint(nodeCount)
+	reader.recordSize = uint(recordSize)
+	reader.ipVersion = uint(ipVersion)
+	treeSize := reader.nodeCount * reader.recordSize / 4
+	if treeSize+16 > uint(start) {
+		return nil, errors.New("Broken MMDB search tree")
+	}
+	reader.data = buf[treeSize+16 : start]
+	return reader, nil
+}
+
+func (reader *mmdbReader) record(node uint, bit uint) uint {
+	b := reader.buf[node*reader.recordSize/4:]
+	switch reader.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// networks calls fn with the first and last address of every network that has data. In IPv6
+// trees IPv4 lives under ::/96 and is aliased from ::ffff:0:0/96 and 2002::/16, the aliases are skipped.
+func (reader *mmdbReader) networks(fn func(start net.IP, end net.IP, offset uint) error) error {
+	bits := uint(128)
+	if reader.ipVersion == 4 {
+		bits = 32
+	}
+	ipv4Start := uint(0)
+	if bits == 128 {
+		for i := 0; i < 96 && ipv4Start < reader.nodeCount; i++ {
+			ipv4Start = reader.record(ipv4Start, 0)
+		}
+	}
+	type step struct {
+		node  uint
+		ip    []byte
+		depth uint
+	}
+	stack := []step{{node: 0, ip: make([]byte, bits/8), depth: 0}}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, bit := range []uint{1, 0} {
+			ip := append([]byte(nil), current.ip...)
+			if bit == 1 {
+				ip[current.depth/8] |= 0x80 >> (current.depth % 8)
+			}
+			depth := current.depth + 1
+			node := reader.record(current.node, bit)
+			switch {
+			case node == reader.nodeCount:
+				continue
+			case node < reader.nodeCount:
+				if bits == 128 && node == ipv4Start && !(depth == 96 && bytes.Equal(ip[:12], make([]byte, 12))) {
+					continue
+				}
+				if depth < bits {
+					stack = append(stack, step{node: node, ip: ip, depth: depth})
+				}
+			default:
+				start, end := net.IP(ip), make(net.IP, len(ip))
+				for i := range ip {
+					end[i] = ip[i]
+					if uint(i*8)+8 <= depth {
+						continue
+					}
+					if uint(i*8) >= depth {
+						end[i] = 0xff
+					} else {
+						end[i] |= 0xff >> (depth - uint(i*8))
+					}
+				}
+				if bits == 128 && bytes.Equal(ip[:12], make([]byte, 12)) && depth >= 96 {
+					start, end = start[12:], end[12:]
+				}
+				if err := fn(start, end, node-reader.nodeCount-16); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decode reads one value of the data section, it returns the offset right after it.
+func (reader *mmdbReader) decode(offset uint) (interface{}, uint, error) {
+	data := reader.data
+	if offset >= uint(len(data)) {
+		return nil, 0, errors.New("Broken MMDB data section")
+	}
+	control := data[offset]
+	offset++
+	kind := uint(control >> 5)
+	if kind == 1 {
+		size := uint(control>>3) & 3
+		if offset+size+1 > uint(len(data)) {
+			return nil, 0, errors.New("Broken MMDB pointer")
+		}
+		var pointer uint
+		switch size {
+		case 0:
+			pointer = uint(control&7)<<8 | uint(data[offset])
+		case 1:
+			pointer = (uint(control&7)<<16 | uint(data[offset])<<8 | uint(data[offset+1])) + 2048
+		case 2:
+			pointer = (uint(control&7)<<24 | uint(data[offset])<<16 | uint(data[offset+1])<<8 | uint(data[offset+2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(data[offset:]))
+		}
+		value, _, err := reader.decode(pointer)
+		return value, offset + size + 1, err
+	}
+	if kind == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, errors.New("Broken MMDB data section")
+		}
+		kind = 7 + uint(data[offset])
+		offset++
+	}
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(data)) {
+			return nil, 0, errors.New("Broken MMDB data section")
+		}
+		var value uint
+		for i := uint(0); i < extra; i++ {
+			value = value<<8 | uint(data[offset+i])
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + value
+		case 2:
+			size = 285 + value
+		default:
+			size = 65821 + value
+		}
+	}
+	switch kind {
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := reader.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := reader.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, _ := key.(string)
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := reader.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(data)) {
+		return nil, 0, errors.New("Broken MMDB data section")
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch kind {
+	case 2:
+		return string(b), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errors.New("Broken MMDB double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errors.New("Broken MMDB float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9:
+		var value uint64
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		return value, offset, nil
+	case 8:
+		var value int32
+		for _, c := range b {
+			value = value<<8 | int32(c)
+		}
+		return int64(value), offset, nil
+	}
+	// bytes, uint128 and containers are not needed for the City database
+	return b, offset, nil
+}
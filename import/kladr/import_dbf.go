@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type dbfField struct {
+	Name   string
+	Offset int
+	Length int
+}
+
+type dbfObject struct {
+	Name   string
+	Abbr   string
+	Index  string
+	Okato  string
+	Status int
+}
+
+// cp866 maps bytes 0x80-0xFF of the DOS Cyrillic code page to runes.
+var cp866 = []rune("АБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯабвгдежзийклмноп" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"рстуфхцчшщъыьэюяЁёЄєЇїЎў°∙·√№¤■ ")
+
+func decodeCP866(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c < 0x80 {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteRune(cp866[c-0x80])
+		}
+	}
+	return sb.String()
+}
+
+// readDbf streams dBase III records, fn gets trimmed CP866-decoded values by field name.
+func readDbf(path string, fn func(record map[string]string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 1<<16)
+	header := make([]byte, 32)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	recordCount := int(binary.LittleEndian.Uint32(header[4:8]))
+	headerLength := int(binary.LittleEndian.Uint16(header[8:10]))
+	recordLength := int(binary.LittleEndian.Uint16(header[10:12]))
+	if headerLength < 33 || recordLength < 1 {
+		return errors.New("Wrong DBF header in " + path)
+	}
+	descriptors := make([]byte, headerLength-32)
+	if _, err = io.ReadFull(reader, descriptors); err != nil {
+		return err
+	}
+	var fields []dbfField
+	offset := 1
+	for i := 0; i+32 <= len(descriptors) && descriptors[i] != 0x0D; i += 32 {
+		name := descriptors[i : i+11]
+		if n := strings.IndexByte(string(name), 0); n >= 0 {
+			name = name[:n]
+		}
+		length := int(descriptors[i+16])
+		fields = append(fields, dbfField{Name: strings.ToUpper(string(name)), Offset: offset, Length: length})
+		offset += length
+	}
+	record := make([]byte, recordLength)
+	values := make(map[string]string, len(fields))
+	for i := 0; i < recordCount; i++ {
+		if _, err = io.ReadFull(reader, record); err != nil {
+			return err
+		}
+		if record[0] == '*' {
+			continue
+		}
+		for _, field := range fields {
+			if field.Offset+field.Length > len(record) {
+				continue
+			}
+			values[field.Name] = strings.TrimSpace(decodeCP866(record[field.Offset : field.Offset+field.Length]))
+		}
+		fn(values)
+	}
+	return nil
+}
+
+// dbfParent derives the parent code from the SS RRR GGG PPP parts of a KLADR code.
+func dbfParent(objects map[string]dbfObject, code string) string {
+	candidates := []string{}
+	if code[8:11] != "000" {
+		candidates = append(candidates, code[:8]+"000")
+	}
+	if code[5:8] != "000" || code[8:11] != "000" {
+		candidates = append(candidates, code[:5]+"000000")
+	}
+	if code[2:5] != "000" || code[5:8] != "000" || code[8:11] != "000" {
+		candidates = append(candidates, code[:2]+"000000000")
+	}
+	for _, candidate := range candidates {
+		if candidate == code {
+			continue
+		}
+		if _, ok := objects[candidate]; ok {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func dbfLevel(code string) string {
+	switch {
+	case code[8:11] != "000":
+		return "4"
+	case code[5:8] != "000":
+		return "3"
+	case code[2:5] != "000":
+		return "2"
+	default:
+		return "1"
+	}
+}
+
+func dbfAncestor(objects map[string]dbfObject, code string) ancestor {
+	id, _ := strconv.Atoi(code + "00")
+	return ancestor{ID: id, Name: objects[code].Name, Type: objects[code].Abbr, Status: objects[code].Status}
+}
+
+func getDbfData(url string, path string) {
+	socr := make(map[string]string)
+	err := readDbf(filepath.Join(path, "SOCRBASE.DBF"), func(record map[string]string) {
+		socr[record["LEVEL"]+record["SCNAME"]] = strings.ToLower(record["SOCRNAME"])
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	objects := make(map[string]dbfObject)
+	outdated := make(map[string]string)
+	err = readDbf(filepath.Join(path, "KLADR.DBF"), func(record map[string]string) {
+		code := record["CODE"]
+		if len(code) != 13 {
+			return
+		}
+		if code[11:] != "00" {
+			outdated[code] = record["NAME"]
+			return
+		}
+		status, _ := strconv.Atoi(record["STATUS"])
+		objects[code[:11]] = dbfObject{Name: record["NAME"], Abbr: record["SOCR"], Index: record["INDEX"], Okato: record["OCATD"], Status: status}
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	altNames := make(map[string][]string)
+	altCodes := make(map[string][]string)
+	err = readDbf(filepath.Join(path, "ALTNAMES.DBF"), func(record map[string]string) {
+		oldCode, newCode := record["OLDCODE"], record["NEWCODE"]
+		if len(newCode) < 11 {
+			return
+		}
+		if len(oldCode) == 13 {
+			altCodes[newCode[:11]] = append(altCodes[newCode[:11]], oldCode)
+		}
+		if name, ok := outdated[oldCode]; ok && name != objects[newCode[:11]].Name {
+			altNames[newCode[:11]] = append(altNames[newCode[:11]], name)
+		}
+	})
+	if err != nil {
+		log.Print(err)
+	}
+	// a renamed object keeps its code with the actuality from 01 to 50 and is not in ALTNAMES
+	for code := range outdated {
+		if code[11:] >= "01" && code[11:] <= "50" {
+			altCodes[code[:11]] = append(altCodes[code[:11]], code)
+		}
+	}
+	log.Print("KLADR objects loaded: ", len(objects))
+	codes := make([]string, 0, len(objects))
+	for code := range objects {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	expand := func(code string) string {
+		if name, ok := socr[dbfLevel(code)+objects[code].Abbr]; ok {
+			return name
+		}
+		return getReplace(objects[code].Abbr)
+	}
+	for _, code := range codes {
+		object := objects[code]
+		docDate := docDate{}
+		docDate.ID, _ = strconv.Atoi(code + "00")
+		docDate.Code = code + "00"
+		docDate.AltCodes = altCodes[code]
+		sort.Strings(docDate.AltCodes)
+		docDate.Postcode = object.Index
+		docDate.Okato = object.Okato
+		docDate.Status = object.Status
+		docDate.LocalityTitle = object.Abbr
+		docDate.LocalityName = object.Name
+		docDate.AltNames = altNames[code]
+		if parent := dbfParent(objects, code); parent != "" {
+			docDate.ParentID, _ = strconv.Atoi(parent + "00")
+		}
+		regionCode := code[:2] + "000000000"
+		region, ok := objects[regionCode]
+		if ok && regionCode != code {
+			var nameArray []string
+			for parent := dbfParent(objects, code); parent != "" && parent != regionCode; parent = dbfParent(objects, parent) {
+				nameArray = append([]string{", " + objects[parent].Name + " " + expand(parent)}, nameArray...)
+				docDate.Ancestors = append([]ancestor{dbfAncestor(objects, parent)}, docDate.Ancestors...)
+			}
+			docDate.RegionID, _ = strconv.Atoi(regionCode + "00")
+			docDate.RegionCode, _ = strconv.Atoi(code[:2])
+			docDate.Ancestors = append([]ancestor{dbfAncestor(objects, regionCode)}, docDate.Ancestors...)
+			docDate.RegionTitle = region.Name + " " + expand(regionCode)
+			docDate.FullName = docDate.RegionTitle + strings.Join(nameArray, " ") + ", " + object.Abbr + ". " + object.Name
+		} else {
+			docDate.FullName = object.Abbr + ". " + object.Name
+		}
+		err = addElasticDoc(docDate, url)
+		if err != nil {
+			log.Print(err)
+		} else {
+			log.Print(docDate.FullName)
+		}
+	}
+}
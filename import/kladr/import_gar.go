@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Only objects down to the settlement level are kept in memory, streets and
+// houses from the hierarchy files are skipped while decoding.
+const garMaxLevel = 6
+
+type garObject struct {
+	GUID       string
+	Name       string
+	Abbr       string
+	Level      int
+	ParentID   int64
+	MunParent  int64
+	RegionCode int
+	Postcode   string
+	Okato      string
+	Oktmo      string
+	Code       string
+	AltCodes   []string
+}
+
+var (
+	garAddrObjRegex = regexp.MustCompile(`(?i)^AS_ADDR_OBJ_\d.*\.xml$`)
+	garAdmRegex     = regexp.MustCompile(`(?i)^AS_ADM_HIERARCHY_\d.*\.xml$`)
+	garMunRegex     = regexp.MustCompile(`(?i)^AS_MUN_HIERARCHY_\d.*\.xml$`)
+	garParamsRegex  = regexp.MustCompile(`(?i)^AS_ADDR_OBJ_PARAMS_\d.*\.xml$`)
+)
+
+func getGarData(url string, path string) {
+	objects := make(map[int64]*garObject)
+	err := walkGar(path, garAddrObjRegex, func(r io.Reader) error {
+		return decodeGar(r, "OBJECT", func(attr map[string]string) {
+			if attr["ISACTUAL"] != "1" || attr["ISACTIVE"] != "1" {
+				return
+			}
+			level, _ := strconv.Atoi(attr["LEVEL"])
+			if level == 0 || level > garMaxLevel {
+				return
+			}
+			id, err := strconv.ParseInt(attr["OBJECTID"], 10, 64)
+			if err != nil {
+				return
+			}
+			objects[id] = &garObject{GUID: attr["OBJECTGUID"], Name: attr["NAME"], Abbr: attr["TYPENAME"], Level: level}
+		})
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = walkGar(path, garAdmRegex, func(r io.Reader) error {
+		return decodeGar(r, "ITEM", func(attr map[string]string) {
+			object := garItem(objects, attr)
+			if object == nil {
+				return
+			}
+			object.ParentID, _ = strconv.ParseInt(attr["PARENTOBJID"], 10, 64)
+			object.RegionCode, _ = strconv.Atoi(attr["REGIONCODE"])
+		})
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = walkGar(path, garMunRegex, func(r io.Reader) error {
+		return decodeGar(r, "ITEM", func(attr map[string]string) {
+			object := garItem(objects, attr)
+			if object == nil {
+				return
+			}
+			object.MunParent, _ = strconv.ParseInt(attr["PARENTOBJID"], 10, 64)
+			if len(attr["OKTMO"]) > 0 {
+				object.Oktmo = attr["OKTMO"]
+			}
+		})
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	today := time.Now().Format("2006-01-02")
+	err = walkGar(path, garParamsRegex, func(r io.Reader) error {
+		return decodeGar(r, "PARAM", func(attr map[string]string) {
+			id, err := strconv.ParseInt(attr["OBJECTID"], 10, 64)
+			if err != nil || objects[id] == nil {
+				return
+			}
+			if attr["ENDDATE"] < today {
+				// a KLADR code replaced by another one still leads to the object
+				if attr["TYPEID"] == "10" && len(attr["VALUE"]) > 0 {
+					objects[id].AltCodes = append(objects[id].AltCodes, attr["VALUE"])
+				}
+				return
+			}
+			switch attr["TYPEID"] {
+			case "5":
+				objects[id].Postcode = attr["VALUE"]
+			case "6":
+				objects[id].Okato = attr["VALUE"]
+			case "7":
+				objects[id].Oktmo = attr["VALUE"]
+			case "10":
+				objects[id].Code = attr["VALUE"]
+			}
+		})
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	log.Print("GAR objects loaded: ", len(objects))
+	ids := make([]int64, 0, len(objects))
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		docDate := garDoc(objects, id)
+		err = addElasticDoc(docDate, url)
+		if err != nil {
+			log.Print(err)
+		} else {
+			log.Print(docDate.FullName)
+		}
+	}
+}
+
+func garItem(objects map[int64]*garObject, attr map[string]string) *garObject {
+	if attr["ISACTIVE"] != "1" {
+		return nil
+	}
+	id, err := strconv.ParseInt(attr["OBJECTID"], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return objects[id]
+}
+
+func garParent(objects map[int64]*garObject, object *garObject) (int64, *garObject) {
+	if parent, ok := objects[object.ParentID]; ok {
+		return object.ParentID, parent
+	}
+	if parent, ok := objects[object.MunParent]; ok {
+		return object.MunParent, parent
+	}
+	return 0, nil
+}
+
+func garDoc(objects map[int64]*garObject, id int64) docDate {
+	object := objects[id]
+	docDate := docDate{}
+	docDate.ID = int(id)
+	docDate.FiasGUID = object.GUID
+	docDate.LocalityTitle = object.Abbr
+	docDate.LocalityName = object.Name
+	docDate.Postcode = object.Postcode
+	docDate.Okato = object.Okato
+	docDate.Oktmo = object.Oktmo
+	docDate.Code = object.Code
+	for _, code := range object.AltCodes {
+		if code != object.Code {
+			docDate.AltCodes = append(docDate.AltCodes, code)
+		}
+	}
+	var nameArray []string
+	var region *garObject
+	parentID, parent := garParent(objects, object)
+	docDate.ParentID = int(parentID)
+	for depth := 0; parent != nil && depth < garMaxLevel; depth++ {
+		if parent.Level == 1 {
+			docDate.RegionID = int(parentID)
+			region = parent
+			break
+		}
+		nameArray = append([]string{", " + parent.Name + " " + getReplace(parent.Abbr)}, nameArray...)
+		docDate.Ancestors = append([]ancestor{{ID: int(parentID), Name: parent.Name, Type: parent.Abbr}}, docDate.Ancestors...)
+		parentID, parent = garParent(objects, parent)
+	}
+	if region != nil {
+		docDate.RegionTitle = region.Name + " " + getReplace(region.Abbr)
+		docDate.RegionGUID = region.GUID
+		docDate.RegionCode = region.RegionCode
+		docDate.Ancestors = append([]ancestor{{ID: docDate.RegionID, Name: region.Name, Type: region.Abbr}}, docDate.Ancestors...)
+		docDate.FullName = docDate.RegionTitle + strings.Join(nameArray, " ") + ", " + object.Abbr + ". " + object.Name
+	} else {
+		docDate.FullName = object.Abbr + ". " + object.Name
+	}
+	return docDate
+}
+
+// walkGar calls fn for every file matching name in a GAR directory or zip archive.
+func walkGar(path string, name *regexp.Regexp, fn func(r io.Reader) error) error {
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			if !name.MatchString(filepath.Base(file.Name)) {
+				continue
+			}
+			log.Print("Read ", file.Name)
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !name.MatchString(info.Name()) {
+			return nil
+		}
+		log.Print("Read ", filePath)
+		r, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return fn(r)
+	})
+}
+
+// decodeGar streams the XML token by token so multi-GB files never sit in memory.
+func decodeGar(r io.Reader, element string, fn func(attr map[string]string)) error {
+	decoder := xml.NewDecoder(r)
+	attr := make(map[string]string)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != element {
+			continue
+		}
+		for k := range attr {
+			delete(attr, k)
+		}
+		for _, a := range start.Attr {
+			attr[a.Name.Local] = a.Value
+		}
+		fn(attr)
+	}
+}
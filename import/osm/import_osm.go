@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/go-resty/resty/v2"
+
+	"kladr/bulk"
+	"kladr/match"
+)
+
+// KLADR abbreviations a place=* value may stand for.
+var osmPlaceTypes = map[string][]string{
+	"city":    {"г"},
+	"town":    {"г", "пгт", "рп", "кп", "дп", "п"},
+	"village": {"с", "д", "п", "пгт", "рп", "кп", "дп", "х", "ст-ца", "аул", "сл", "нп", "п/ст", "м", "у"},
+}
+
+func initMapping(url string) error {
+	client := resty.New()
+	resp, err := client.R().SetHeader("Content-Type", "application/json").SetBody(`{"properties":{"location":{"type":"geo_point"}}}`).Put(url + "/_mapping")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == 200 {
+		return nil
+	}
+	return errors.New("Can't add location to index mapping")
+}
+
+func getOsmData(url string, path string) {
+	var places []osmPlace
+	err := readPbf(path, func(place osmPlace) {
+		if _, ok := osmPlaceTypes[place.Tags["place"]]; ok && len(osmName(place)) > 0 {
+			places = append(places, place)
+		}
+	})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	log.Print("OSM places loaded: ", len(places))
+	client := resty.New()
+	matches, ambiguous, missed := matchPlaces(places, func(place osmPlace) ([]match.Locality, error) {
+		return matchPlace(client, url, place)
+	})
+	for _, v := range matches {
+		location := strconv.FormatFloat(v.place.Lat, 'f', 6, 64) + "," + strconv.FormatFloat(v.place.Lon, 'f', 6, 64)
+		doc, _ := json.Marshal(map[string]string{"location": location})
+		// the kladr importers index a locality under its doc_id
+		err = bulk.Default(url).Update(strconv.Itoa(v.locality.ID), doc)
+		if err != nil {
+			log.Print(err)
+		}
+		log.Print(v.locality.FullName, " ", location)
+	}
+	if err := bulk.Close(); err != nil {
+		log.Print(err)
+	}
+	log.Print("OSM places matched: ", len(matches), "; ambiguous: ", ambiguous, "; not found: ", missed)
+}
+
+type placeMatch struct {
+	place    osmPlace
+	locality match.Locality
+}
+
+// pendingPlace is a place with several localities left for the second pass.
+type pendingPlace struct {
+	place      osmPlace
+	candidates []match.Locality
+}
+
+// matchPlaces links the places to localities in two passes. Place nodes seldom carry addr:region,
+// so a place left with localities of several regions gets the region of the nearest place matched
+// in the first pass. It returns the matches and the numbers of ambiguous and not found places.
+func matchPlaces(places []osmPlace, find func(place osmPlace) ([]match.Locality, error)) ([]placeMatch, int, int) {
+	var matches []placeMatch
+	var pending []pendingPlace
+	assigned := make(map[int]int64)
+	ambiguous, missed := 0, 0
+	accept := func(place osmPlace, locality match.Locality) {
+		if nodeID, ok := assigned[locality.ID]; ok {
+			ambiguous++
+			log.Print("OSM nodes ", nodeID, " and ", place.ID, " both match ", locality.FullName)
+			return
+		}
+		assigned[locality.ID] = place.ID
+		matches = append(matches, placeMatch{place, locality})
+	}
+	for _, place := range places {
+		found, err := find(place)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		switch {
+		case len(found) == 0:
+			missed++
+		case len(found) > 1:
+			pending = append(pending, pendingPlace{place, found})
+		default:
+			accept(place, found[0])
+		}
+	}
+	grid := make(placeGrid)
+	for _, v := range matches {
+		grid.add(v.place.Lat, v.place.Lon, match.RegionOf(v.locality))
+	}
+	for _, v := range pending {
+		found := match.InRegion(v.candidates, grid.nearestRegion(v.place.Lat, v.place.Lon))
+		if len(found) != 1 {
+			ambiguous++
+			log.Print("Ambiguous OSM node ", v.place.ID, " ", osmName(v.place), ": ", len(v.candidates), " localities")
+			continue
+		}
+		accept(v.place, found[0])
+	}
+	return matches, ambiguous, missed
+}
+
+// matchPlace narrows localities with the same name down by type, then by region and district
+// when the node carries addr:* or is_in:* tags.
+func matchPlace(client *resty.Client, url string, place osmPlace) ([]match.Locality, error) {
+	name := osmName(place)
+	found, err := match.Search(client, url, name)
+	if err != nil {
+		return nil, err
+	}
+	candidates := match.Name(found, name, func(title string) bool {
+		return containsType(osmPlaceTypes[place.Tags["place"]], title)
+	})
+	candidates = match.Region(candidates, osmTag(place, "addr:region", "is_in:region", "is_in:state"))
+	return match.District(candidates, osmTag(place, "addr:district", "is_in:district")), nil
+}
+
+func osmName(place osmPlace) string {
+	return osmTag(place, "name:ru", "name")
+}
+
+func osmTag(place osmPlace, keys ...string) string {
+	for _, key := range keys {
+		if len(place.Tags[key]) > 0 {
+			return place.Tags[key]
+		}
+	}
+	return ""
+}
+
+func containsType(types []string, abbr string) bool {
+	for _, v := range types {
+		if v == abbr {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	if len(os.Getenv("OSM_PATH")) == 0 {
+		log.Panic("Env variable OSM_PATH is null\nExample: /data/russia-latest.osm.pbf")
+	}
+	elasticURL := `http://localhost:9200/kladr`
+	if len(os.Getenv("ELASTIC")) > 0 {
+		elasticURL = os.Getenv("ELASTIC")
+	}
+	err := initMapping(elasticURL)
+	if err != nil {
+		log.Panicf("Unable to Elastic establish connection: %v\n", err)
+	}
+	getOsmData(elasticURL, os.Getenv("OSM_PATH"))
+}
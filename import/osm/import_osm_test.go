@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"kladr/match"
+)
+
+func TestMatchPlaces(t *testing.T) {
+	tumen := match.Locality{ID: 2, FullName: "Тюмень г, Тюменская обл", RegionID: 1}
+	zarechnyTumen := match.Locality{ID: 3, FullName: "Заречный п, Тюменская обл", RegionID: 1}
+	zarechnySverdl := match.Locality{ID: 4, FullName: "Заречный г, Свердловская обл", RegionID: 10}
+	ekb := match.Locality{ID: 5, FullName: "Екатеринбург г, Свердловская обл", RegionID: 10}
+	found := map[string][]match.Locality{
+		"Тюмень":       {tumen},
+		"Екатеринбург": {ekb},
+		"Заречный":     {zarechnyTumen, zarechnySverdl},
+		"Ивановка":     {{ID: 6, RegionID: 20}, {ID: 7, RegionID: 30}},
+	}
+	place := func(id int64, name string, lat float64, lon float64) osmPlace {
+		return osmPlace{ID: id, Lat: lat, Lon: lon, Tags: map[string]string{"name": name}}
+	}
+	places := []osmPlace{
+		// Заречный near Екатеринбург is read before the city, it waits for the second pass
+		place(1, "Заречный", 56.81, 61.33),
+		place(2, "Тюмень", 57.15, 65.53),
+		place(3, "Екатеринбург", 56.84, 60.6),
+		place(4, "Лесной", 57.0, 65.0),
+		// no matched place within gridRadius
+		place(5, "Ивановка", 45.0, 40.0),
+		// the second node of Тюмень
+		place(6, "Тюмень", 57.16, 65.54),
+	}
+	matches, ambiguous, missed := matchPlaces(places, func(place osmPlace) ([]match.Locality, error) {
+		return found[osmName(place)], nil
+	})
+	var got []int
+	for _, v := range matches {
+		got = append(got, int(v.place.ID), v.locality.ID)
+	}
+	if want := []int{2, 2, 3, 5, 1, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matches (node, locality): %v, want %v", got, want)
+	}
+	if ambiguous != 2 || missed != 1 {
+		t.Errorf("ambiguous %d, not found %d, want 2 and 1", ambiguous, missed)
+	}
+}
+
+func TestNearestRegion(t *testing.T) {
+	grid := make(placeGrid)
+	grid.add(57.15, 65.53, 1)
+	grid.add(56.84, 60.6, 10)
+	tests := []struct {
+		lat, lon float64
+		want     int
+	}{
+		{57.1, 65.0, 1},
+		{56.8, 61.3, 10},
+		// in another cell but closer to Тюмень
+		{57.4, 64.1, 1},
+		{60.0, 75.0, 0},
+	}
+	for _, test := range tests {
+		if got := grid.nearestRegion(test.lat, test.lon); got != test.want {
+			t.Errorf("nearestRegion(%v, %v) = %d, want %d", test.lat, test.lon, got, test.want)
+		}
+	}
+}
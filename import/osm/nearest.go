@@ -0,0 +1,46 @@
+package main
+
+import "math"
+
+// placeGrid buckets the matched places by gridCell degrees to find the nearest one fast.
+type placeGrid map[[2]int][]gridPlace
+
+type gridPlace struct {
+	lat      float64
+	lon      float64
+	regionID int
+}
+
+const (
+	gridCell = 0.5
+	// cells looked at around a place in each direction, about 200 km to the north and south
+	gridRadius = 4
+)
+
+func gridKey(lat float64, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / gridCell)), int(math.Floor(lon / gridCell))}
+}
+
+func (grid placeGrid) add(lat float64, lon float64, regionID int) {
+	key := gridKey(lat, lon)
+	grid[key] = append(grid[key], gridPlace{lat, lon, regionID})
+}
+
+// nearestRegion returns the region of the nearest place within gridRadius cells, 0 when there is none.
+// The distance is planar with the longitude scaled down by the latitude, that is enough to compare.
+func (grid placeGrid) nearestRegion(lat float64, lon float64) int {
+	key := gridKey(lat, lon)
+	scale := math.Cos(lat * math.Pi / 180)
+	regionID, best := 0, math.MaxFloat64
+	for dlat := -gridRadius; dlat <= gridRadius; dlat++ {
+		for dlon := -gridRadius; dlon <= gridRadius; dlon++ {
+			for _, place := range grid[[2]int{key[0] + dlat, key[1] + dlon}] {
+				y, x := place.lat-lat, (place.lon-lon)*scale
+				if distance := y*y + x*x; distance < best {
+					regionID, best = place.regionID, distance
+				}
+			}
+		}
+	}
+	return regionID
+}
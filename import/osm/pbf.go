@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// The PBF format is a sequence of length-prefixed protobuf blobs, see
+// https://wiki.openstreetmap.org/wiki/PBF_Format. Only what is needed to read
+// place nodes is decoded: ways, relations and metadata are skipped.
+
+type osmPlace struct {
+	ID   int64
+	Lat  float64
+	Lon  float64
+	Tags map[string]string
+}
+
+type pbfBlock struct {
+	strings     [][]byte
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+	placeKey    int
+}
+
+func readPbf(path string, fn func(place osmPlace)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, 1<<20)
+	sizeBuf := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(r, sizeBuf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		header := make([]byte, binary.BigEndian.Uint32(sizeBuf))
+		if _, err = io.ReadFull(r, header); err != nil {
+			return err
+		}
+		var blobType string
+		var blobSize uint64
+		err = pbfMessage(header, func(field int, value uint64, data []byte) {
+			switch field {
+			case 1:
+				blobType = string(data)
+			case 3:
+				blobSize = value
+			}
+		})
+		if err != nil {
+			return err
+		}
+		blob := make([]byte, blobSize)
+		if _, err = io.ReadFull(r, blob); err != nil {
+			return err
+		}
+		if blobType != "OSMData" {
+			continue
+		}
+		data, err := pbfBlobData(blob)
+		if err != nil {
+			return err
+		}
+		if err = pbfPrimitiveBlock(data, fn); err != nil {
+			return err
+		}
+	}
+}
+
+func pbfBlobData(blob []byte) ([]byte, error) {
+	var raw, compressed []byte
+	err := pbfMessage(blob, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			raw = data
+		case 3:
+			compressed = data
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		return raw, nil
+	}
+	if compressed == nil {
+		return nil, errors.New("Unsupported PBF blob compression, only raw and zlib are read")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+func pbfPrimitiveBlock(data []byte, fn func(place osmPlace)) error {
+	block := pbfBlock{granularity: 100, placeKey: -1}
+	var groups [][]byte
+	err := pbfMessage(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			pbfMessage(data, func(field int, value uint64, data []byte) {
+				if field == 1 {
+					block.strings = append(block.strings, data)
+				}
+			})
+		case 2:
+			groups = append(groups, data)
+		case 17:
+			block.granularity = int64(value)
+		case 19:
+			block.latOffset = int64(value)
+		case 20:
+			block.lonOffset = int64(value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for i, s := range block.strings {
+		if string(s) == "place" {
+			block.placeKey = i
+			break
+		}
+	}
+	// a block without the "place" string can't hold a place node
+	if block.placeKey == -1 {
+		return nil
+	}
+	for _, group := range groups {
+		err = pbfMessage(group, func(field int, value uint64, data []byte) {
+			switch field {
+			case 1:
+				block.node(data, fn)
+			case 2:
+				block.denseNodes(data, fn)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (block *pbfBlock) node(data []byte, fn func(place osmPlace)) {
+	var id, lat, lon int64
+	var keys, vals []uint64
+	pbfMessage(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			id = pbfZigzag(value)
+		case 2:
+			keys = pbfPacked(data)
+		case 3:
+			vals = pbfPacked(data)
+		case 8:
+			lat = pbfZigzag(value)
+		case 9:
+			lon = pbfZigzag(value)
+		}
+	})
+	var keysVals []uint64
+	for i := 0; i < len(keys) && i < len(vals); i++ {
+		keysVals = append(keysVals, keys[i], vals[i])
+	}
+	block.place(id, lat, lon, keysVals, fn)
+}
+
+// denseNodes reads delta coded ids and coordinates, tags of all nodes are packed
+// into one keys_vals array where every node ends with 0.
+func (block *pbfBlock) denseNodes(data []byte, fn func(place osmPlace)) {
+	var ids, lats, lons, keysVals []uint64
+	pbfMessage(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			ids = pbfPacked(data)
+		case 8:
+			lats = pbfPacked(data)
+		case 9:
+			lons = pbfPacked(data)
+		case 10:
+			keysVals = pbfPacked(data)
+		}
+	})
+	var id, lat, lon int64
+	kv := 0
+	for i := 0; i < len(ids) && i < len(lats) && i < len(lons); i++ {
+		id += pbfZigzag(ids[i])
+		lat += pbfZigzag(lats[i])
+		lon += pbfZigzag(lons[i])
+		if kv >= len(keysVals) {
+			continue
+		}
+		start := kv
+		for kv < len(keysVals) && keysVals[kv] != 0 {
+			kv += 2
+		}
+		if kv > len(keysVals) {
+			kv = len(keysVals)
+		}
+		block.place(id, lat, lon, keysVals[start:kv], fn)
+		kv++
+	}
+}
+
+func (block *pbfBlock) place(id int64, lat int64, lon int64, keysVals []uint64, fn func(place osmPlace)) {
+	isPlace := false
+	for i := 0; i+1 < len(keysVals); i += 2 {
+		if int(keysVals[i]) == block.placeKey {
+			isPlace = true
+			break
+		}
+	}
+	if !isPlace {
+		return
+	}
+	place := osmPlace{ID: id, Tags: make(map[string]string)}
+	place.Lat = 1e-9 * float64(block.latOffset+block.granularity*lat)
+	place.Lon = 1e-9 * float64(block.lonOffset+block.granularity*lon)
+	for i := 0; i+1 < len(keysVals); i += 2 {
+		if keysVals[i] < uint64(len(block.strings)) && keysVals[i+1] < uint64(len(block.strings)) {
+			place.Tags[string(block.strings[keysVals[i]])] = string(block.strings[keysVals[i+1]])
+		}
+	}
+	fn(place)
+}
+
+// pbfMessage walks the fields of a protobuf message, value is set for varint and
+// fixed fields, data for length-delimited ones.
+func pbfMessage(buf []byte, fn func(field int, value uint64, data []byte)) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errors.New("Broken PBF message")
+		}
+		buf = buf[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			value, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errors.New("Broken PBF message")
+			}
+			buf = buf[n:]
+			fn(field, value, nil)
+		case 1:
+			if len(buf) < 8 {
+				return errors.New("Broken PBF message")
+			}
+			fn(field, binary.LittleEndian.Uint64(buf), nil)
+			buf = buf[8:]
+		case 2:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return errors.New("Broken PBF message")
+			}
+			fn(field, 0, buf[n:n+int(size)])
+			buf = buf[n+int(size):]
+		case 5:
+			if len(buf) < 4 {
+				return errors.New("Broken PBF message")
+			}
+			fn(field, uint64(binary.LittleEndian.Uint32(buf)), nil)
+			buf = buf[4:]
+		default:
+			return errors.New("Unsupported PBF wire type")
+		}
+	}
+	return nil
+}
+
+func pbfPacked(data []byte) []uint64 {
+	var values []uint64
+	for len(data) > 0 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			break
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values
+}
+
+func pbfZigzag(value uint64) int64 {
+	return int64(value>>1) ^ -int64(value&1)
+}
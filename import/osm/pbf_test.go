@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestReadPbf(t *testing.T) {
+	var places []osmPlace
+	// testdata/places.osm.pbf: a raw header blob, a zlib data block with dense nodes and a plain node,
+	// and a raw data block without place nodes
+	err := readPbf("testdata/places.osm.pbf", func(place osmPlace) {
+		places = append(places, place)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []osmPlace{
+		{ID: 1001, Lat: 57.153033, Lon: 65.534328, Tags: map[string]string{"place": "city", "name": "Тюмень", "name:ru": "Тюмень"}},
+		{ID: 1004, Lat: 56.9, Lon: 65.9, Tags: map[string]string{"place": "village", "name": "Заречный", "addr:region": "Тюменская область"}},
+		{ID: 2001, Lat: 58.2, Lon: 68.25, Tags: map[string]string{"place": "town", "name": "Тобольск"}},
+	}
+	if len(places) != len(want) {
+		t.Fatalf("%d places, want %d: %+v", len(places), len(want), places)
+	}
+	for i, place := range places {
+		if place.ID != want[i].ID || math.Abs(place.Lat-want[i].Lat) > 1e-7 || math.Abs(place.Lon-want[i].Lon) > 1e-7 {
+			t.Errorf("place %d: %d %v,%v, want %d %v,%v", i, place.ID, place.Lat, place.Lon, want[i].ID, want[i].Lat, want[i].Lon)
+		}
+		if !reflect.DeepEqual(place.Tags, want[i].Tags) {
+			t.Errorf("place %d tags: %v, want %v", i, place.Tags, want[i].Tags)
+		}
+	}
+}
+
+func TestReadPbfBroken(t *testing.T) {
+	if err := readPbf("testdata/missing.osm.pbf", func(osmPlace) {}); err == nil {
+		t.Error("no error for a missing file")
+	}
+	if err := pbfMessage([]byte{0x0a, 0x05, 'a'}, func(int, uint64, []byte) {}); err == nil {
+		t.Error("no error for a truncated field")
+	}
+}
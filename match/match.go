@@ -0,0 +1,142 @@
+// Package match narrows the Kladr localities found by a name down to the one an outside source
+// means, a GeoIP city in import/geo or an OSM place in import/osm, by type, region and district.
+package match
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Locality is the part of a Kladr document the matching reads.
+type Locality struct {
+	ID            int    `json:"doc_id"`
+	Status        int    `json:"status"`
+	FullName      string `json:"full_name"`
+	LocalityTitle string `json:"locality_title"`
+	LocalityName  string `json:"locality_name"`
+	RegionID      int    `json:"region_id"`
+	RegionTitle   string `json:"region_title"`
+}
+
+type searchResult struct {
+	Hits struct {
+		Hits []struct {
+			Source Locality `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Generic words skipped when region and district names are compared: "Республика Татарстан" and
+// "Татарстан республика" both reduce to "татарстан".
+var genericWords = map[string]bool{"область": true, "обл": true, "край": true, "республика": true, "респ": true, "автономный": true, "автономная": true, "округ": true, "ао": true, "аобл": true, "район": true, "р-н": true, "город": true, "г": true, "федеральный": true, "-": true, "—": true}
+
+// Search returns the localities of the Kladr index url with all words of the name.
+func Search(client *resty.Client, url string, name string) ([]Locality, error) {
+	query := map[string]interface{}{
+		"query":   map[string]interface{}{"match": map[string]interface{}{"locality_name": map[string]string{"query": name, "operator": "and"}}},
+		"_source": map[string][]string{"excludes": {"ancestors"}},
+		"size":    50,
+	}
+	body, _ := json.Marshal(query)
+	resp, err := client.R().SetHeader("Content-Type", "application/json").SetBody(body).Post(url + "/_search")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != 200 {
+		return nil, errors.New("Elastic Response Error: " + string(resp.Body()))
+	}
+	var result searchResult
+	if err = json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, err
+	}
+	var found []Locality
+	for _, hit := range result.Hits.Hits {
+		found = append(found, hit.Source)
+	}
+	return found, nil
+}
+
+func Normalize(a string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(a)), "ё", "е", -1)
+}
+
+// Core keeps the first word of a region or district name that is not a type.
+func Core(a string) string {
+	for _, word := range strings.Fields(Normalize(a)) {
+		if !genericWords[strings.TrimSuffix(word, ".")] {
+			return word
+		}
+	}
+	return ""
+}
+
+// Name keeps the localities named exactly so, a search also finds longer names with the same words,
+// and of a type the source can mean.
+func Name(found []Locality, name string, isType func(title string) bool) []Locality {
+	var candidates []Locality
+	for _, v := range found {
+		if Normalize(v.LocalityName) == Normalize(name) && isType(v.LocalityTitle) {
+			candidates = append(candidates, v)
+		}
+	}
+	return candidates
+}
+
+// Region keeps the localities of the region, a region document is compared by its own name.
+// Without a region all candidates stay.
+func Region(candidates []Locality, region string) []Locality {
+	if len(region) == 0 {
+		return candidates
+	}
+	var filtered []Locality
+	for _, v := range candidates {
+		regionTitle := v.RegionTitle
+		if v.RegionID == 0 {
+			regionTitle = v.LocalityName
+		}
+		if Core(regionTitle) == Core(region) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+// District narrows several candidates to those with the district in the full name, the candidates
+// stay when none has it.
+func District(candidates []Locality, district string) []Locality {
+	if len(candidates) < 2 || len(district) == 0 {
+		return candidates
+	}
+	var filtered []Locality
+	for _, v := range candidates {
+		if strings.Contains(Normalize(v.FullName), Core(district)) {
+			filtered = append(filtered, v)
+		}
+	}
+	if len(filtered) == 0 {
+		return candidates
+	}
+	return filtered
+}
+
+// RegionOf returns the region ID of the locality, a region document is its own region.
+func RegionOf(v Locality) int {
+	if v.RegionID == 0 {
+		return v.ID
+	}
+	return v.RegionID
+}
+
+// InRegion keeps the localities of the region with the ID.
+func InRegion(candidates []Locality, regionID int) []Locality {
+	var filtered []Locality
+	for _, v := range candidates {
+		if RegionOf(v) == regionID {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
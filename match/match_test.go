@@ -0,0 +1,74 @@
+package match
+
+import (
+	"reflect"
+	"testing"
+)
+
+var localities = []Locality{
+	{ID: 1, FullName: "Тюменская обл", LocalityTitle: "обл", LocalityName: "Тюменская"},
+	{ID: 2, FullName: "Заречный г, Свердловская обл", LocalityTitle: "г", LocalityName: "Заречный", RegionID: 10, RegionTitle: "Свердловская обл"},
+	{ID: 3, FullName: "Заречный п, Тюменский р-н, Тюменская обл", LocalityTitle: "п", LocalityName: "Заречный", RegionID: 1, RegionTitle: "Тюменская обл"},
+	{ID: 4, FullName: "Заречный п, Ишимский р-н, Тюменская обл", LocalityTitle: "п", LocalityName: "Заречный", RegionID: 1, RegionTitle: "Тюменская обл"},
+	{ID: 5, FullName: "Заречный Лог д, Тюменский р-н, Тюменская обл", LocalityTitle: "д", LocalityName: "Заречный Лог", RegionID: 1, RegionTitle: "Тюменская обл"},
+}
+
+func ids(list []Locality) []int {
+	var result []int
+	for _, v := range list {
+		result = append(result, v.ID)
+	}
+	return result
+}
+
+func TestCore(t *testing.T) {
+	tests := map[string]string{
+		"Республика Татарстан":  "татарстан",
+		"Татарстан Респ.":       "татарстан",
+		"Ханты-Мансийский АО":   "ханты-мансийский",
+		" Тюменский  р-н ":      "тюменский",
+		"Уральский федеральный": "уральский",
+		"Ёлкинский район":       "елкинский",
+		"область":               "",
+	}
+	for name, want := range tests {
+		if got := Core(name); got != want {
+			t.Errorf("Core(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	anyType := func(string) bool { return true }
+	settlement := func(title string) bool { return title == "п" || title == "д" }
+	if got := ids(Name(localities, "заречный", anyType)); !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Errorf("name: %v", got)
+	}
+	if got := ids(Name(localities, "Заречный", settlement)); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("name and type: %v", got)
+	}
+	candidates := Name(localities, "Заречный", anyType)
+	if got := ids(Region(candidates, "Тюменская область")); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("region: %v", got)
+	}
+	if got := ids(Region(candidates, "")); !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Errorf("no region: %v", got)
+	}
+	// a region document is compared by its own name
+	if got := ids(Region(localities[:1], "обл. Тюменская")); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("region document: %v", got)
+	}
+	if got := ids(District(Region(candidates, "Тюменская"), "Ишимский район")); !reflect.DeepEqual(got, []int{4}) {
+		t.Errorf("district: %v", got)
+	}
+	// an unknown district keeps the candidates, the caller decides on ambiguity
+	if got := ids(District(Region(candidates, "Тюменская"), "Омутинский район")); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("unknown district: %v", got)
+	}
+	if got := ids(InRegion(candidates, 1)); !reflect.DeepEqual(got, []int{3, 4}) {
+		t.Errorf("region id: %v", got)
+	}
+	if got := ids(InRegion(localities, 1)); !reflect.DeepEqual(got, []int{1, 3, 4, 5}) {
+		t.Errorf("region id with the region document: %v", got)
+	}
+}
@@ -0,0 +1,907 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"kladr/snapshot"
+)
+
+// In-memory backend: documents are loaded from JSONL dumps of the indices or from a mapped
+// snapshot file and the typed queries from query.go are evaluated against them, so the handlers
+// get the same hits, scores and order as from Elasticsearch without a running cluster.
+
+var memoryIPFields = map[string]bool{"start_ip": true, "end_ip": true}
+
+type memorySearcher struct {
+	indices map[string]*memoryIndex
+}
+
+// memoryIndex keeps the documents and the term dictionaries in a snapshot index, built in memory
+// for the dumps, and adds what is cheap to build at load: trigrams and the ip ranges.
+type memoryIndex struct {
+	docs   *snapshot.Index
+	terms  map[string]*memoryTerms
+	keys   map[string]*snapshot.Terms
+	ranges *memoryRanges
+}
+
+// memoryTerms is the term dictionary of a text field: sorted tokens for prefix lookups, trigrams
+// of the tokens for substring lookups and postings with the positions of the documents.
+type memoryTerms struct {
+	*snapshot.Terms
+	grams map[string][]int
+}
+
+// memoryRanges finds the ip ranges holding an address: ranges sorted by start_ip with the running
+// maximum of end_ip, the walk back from the last range starting before the address stops when no
+// earlier range reaches it.
+type memoryRanges struct {
+	pos    []int
+	starts [][]byte
+	ends   [][]byte
+	maxEnd [][]byte
+}
+
+type memoryHit struct {
+	pos   int
+	score float64
+	named []string
+	sort  []interface{}
+}
+
+type memoryQuery struct {
+	index    *memoryIndex
+	patterns map[string]*regexp.Regexp
+	named    []string
+}
+
+func newMemorySearcher(paths map[string]string) (*memorySearcher, error) {
+	searcher := &memorySearcher{indices: make(map[string]*memoryIndex)}
+	for index, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		sources, err := readMemoryDump(path)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := snapshot.Build(sources)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		searcher.indices[index] = newMemoryIndex(docs)
+	}
+	return searcher, nil
+}
+
+// newSnapshotSearcher serves every index of the snapshot, the documents stay in the mapped file.
+func newSnapshotSearcher(file *snapshot.Snapshot) *memorySearcher {
+	searcher := &memorySearcher{indices: make(map[string]*memoryIndex)}
+	for _, index := range file.Indices() {
+		searcher.indices[index] = newMemoryIndex(file.Index(index))
+	}
+	return searcher
+}
+
+// readMemoryDump reads one document per line, either the bare _source or a hit with _index, _id
+// and _source as elasticdump writes it.
+func readMemoryDump(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var sources [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1<<20), 64<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var hit struct {
+			Source json.RawMessage `json:"_source"`
+		}
+		if err := json.Unmarshal(data, &hit); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if hit.Source == nil {
+			hit.Source = append(json.RawMessage(nil), data...)
+		}
+		sources = append(sources, hit.Source)
+	}
+	return sources, scanner.Err()
+}
+
+func newMemoryIndex(docs *snapshot.Index) *memoryIndex {
+	index := &memoryIndex{docs: docs, terms: make(map[string]*memoryTerms), keys: make(map[string]*snapshot.Terms)}
+	for _, field := range docs.Fields() {
+		dictionary := docs.Terms(field)
+		switch {
+		case dictionary == nil:
+		case snapshot.TextFields[field]:
+			terms := &memoryTerms{Terms: dictionary, grams: make(map[string][]int)}
+			for id := 0; id < terms.Len(); id++ {
+				for _, gram := range trigrams(terms.Token(id)) {
+					if grams := terms.grams[gram]; len(grams) == 0 || grams[len(grams)-1] != id {
+						terms.grams[gram] = append(grams, id)
+					}
+				}
+			}
+			index.terms[field] = terms
+		default:
+			index.keys[field] = dictionary
+		}
+	}
+	index.ranges = newMemoryRanges(docs)
+	return index
+}
+
+func trigrams(a string) []string {
+	runes := []rune(a)
+	var grams []string
+	for i := 0; i+3 <= len(runes); i++ {
+		grams = append(grams, string(runes[i:i+3]))
+	}
+	return grams
+}
+
+// newMemoryRanges returns nil for an index without ip ranges.
+func newMemoryRanges(docs *snapshot.Index) *memoryRanges {
+	ranges := &memoryRanges{}
+	for pos := 0; pos < docs.Len(); pos++ {
+		start := net.ParseIP(memoryString(firstOf(docs.Values(pos, "start_ip"))))
+		end := net.ParseIP(memoryString(firstOf(docs.Values(pos, "end_ip"))))
+		if start == nil || end == nil {
+			continue
+		}
+		ranges.pos = append(ranges.pos, pos)
+		ranges.starts = append(ranges.starts, start.To16())
+		ranges.ends = append(ranges.ends, end.To16())
+	}
+	if len(ranges.pos) == 0 {
+		return nil
+	}
+	sort.Sort(ranges)
+	ranges.maxEnd = make([][]byte, len(ranges.ends))
+	for i, end := range ranges.ends {
+		ranges.maxEnd[i] = end
+		if i > 0 && bytes.Compare(ranges.maxEnd[i-1], end) > 0 {
+			ranges.maxEnd[i] = ranges.maxEnd[i-1]
+		}
+	}
+	return ranges
+}
+
+func (ranges *memoryRanges) Len() int {
+	return len(ranges.pos)
+}
+
+func (ranges *memoryRanges) Less(i, j int) bool {
+	return bytes.Compare(ranges.starts[i], ranges.starts[j]) < 0
+}
+
+func (ranges *memoryRanges) Swap(i, j int) {
+	ranges.pos[i], ranges.pos[j] = ranges.pos[j], ranges.pos[i]
+	ranges.starts[i], ranges.starts[j] = ranges.starts[j], ranges.starts[i]
+	ranges.ends[i], ranges.ends[j] = ranges.ends[j], ranges.ends[i]
+}
+
+// stab returns the sorted positions of the ranges holding the address.
+func (ranges *memoryRanges) stab(ip net.IP) []int {
+	var result []int
+	i := sort.Search(len(ranges.starts), func(i int) bool { return bytes.Compare(ranges.starts[i], ip) > 0 }) - 1
+	for ; i >= 0 && bytes.Compare(ranges.maxEnd[i], ip) >= 0; i-- {
+		if bytes.Compare(ranges.ends[i], ip) >= 0 {
+			result = append(result, ranges.pos[i])
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+func (index *memoryIndex) values(pos int, field string) []interface{} {
+	return index.docs.Values(pos, field)
+}
+
+// tokens analyzes the values of a text field the way they were indexed.
+func (index *memoryIndex) tokens(pos int, field string) []string {
+	var tokens []string
+	for _, v := range index.docs.Values(pos, field) {
+		tokens = append(tokens, snapshot.Analyze(memoryString(v))...)
+	}
+	return tokens
+}
+
+func (index *memoryIndex) firstValue(pos int, field string) interface{} {
+	return firstOf(index.docs.Values(pos, field))
+}
+
+func (searcher *memorySearcher) Ping() error {
+	if index, ok := searcher.indices[indexKladr]; !ok || index.docs.Len() == 0 {
+		return errors.New("Index KLADR not loaded")
+	}
+	return nil
+}
+
+func (searcher *memorySearcher) Search(index string, query esSearch) (searchResponse, error) {
+	var resp searchResponse
+	// a query Elasticsearch wouldn't get is refused here as well
+	if _, err := query.String(); err != nil {
+		return resp, err
+	}
+	resp.Shards.Total, resp.Shards.Successful = 1, 1
+	resp.Hits.Total.Relation = "eq"
+	target, ok := searcher.indices[index]
+	if !ok {
+		return resp, nil
+	}
+	q := &memoryQuery{index: target, patterns: make(map[string]*regexp.Regexp)}
+	if len(query.Suggest) > 0 {
+		resp.Suggest = make(map[string][]suggestEntry)
+		for name, suggest := range query.Suggest {
+			resp.Suggest[name] = q.suggest(suggest)
+		}
+	}
+	if query.Query == nil {
+		return resp, nil
+	}
+	candidates, ok := q.candidates(query.Query)
+	if !ok {
+		candidates = make([]int, target.docs.Len())
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+	var hits []memoryHit
+	for _, pos := range candidates {
+		q.named = nil
+		matched, score := q.match(query.Query, pos)
+		if matched {
+			hits = append(hits, memoryHit{pos: pos, score: score, named: q.named})
+		}
+	}
+	q.sort(hits, query.Sort)
+	resp.Hits.Total.Value = len(hits)
+	for i := query.From; i < len(hits) && i < query.From+query.Size; i++ {
+		hit := hits[i]
+		score := hit.score
+		source := json.RawMessage(target.docs.Source(hit.pos))
+		if query.Source != nil && len(query.Source.Excludes) > 0 {
+			source = excludeFields(source, query.Source.Excludes)
+		}
+		resp.Hits.Hits = append(resp.Hits.Hits, searchHit{
+			Index:          index,
+			ID:             memoryString(target.firstValue(hit.pos, "doc_id")),
+			Score:          &score,
+			Source:         source,
+			Sort:           hit.sort,
+			MatchedQueries: hit.named,
+		})
+	}
+	return resp, nil
+}
+
+func excludeFields(source json.RawMessage, excludes []string) json.RawMessage {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(source, &values); err != nil {
+		return source
+	}
+	for _, field := range excludes {
+		delete(values, field)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return source
+	}
+	return data
+}
+
+// candidates narrows the documents down with the term dictionaries, ok is false when the clause
+// can't be answered from them and every document has to be checked by match.
+func (q *memoryQuery) candidates(clause esClause) ([]int, bool) {
+	switch c := clause.(type) {
+	case esTerm:
+		return q.termCandidates(c.Field, []interface{}{c.Value})
+	case esTerms:
+		return q.termCandidates(c.Field, memoryList(c.Values))
+	case esWildcard:
+		terms, ok := q.index.terms[c.Field]
+		if !ok {
+			return nil, false
+		}
+		pattern := q.pattern(c.Value)
+		var lists [][]int
+		for _, id := range terms.lookup(wildcardLiteral(c.Value)) {
+			if pattern.MatchString(terms.Token(id)) {
+				lists = append(lists, terms.Postings(id))
+			}
+		}
+		return union(lists), true
+	case esMatch:
+		terms, ok := q.index.terms[c.Field]
+		if !ok || c.Operator != "and" {
+			return nil, false
+		}
+		var result []int
+		for i, token := range snapshot.Analyze(c.Query) {
+			var lists [][]int
+			for _, id := range terms.fuzzy(token, c.Fuzziness, c.PrefixLength) {
+				lists = append(lists, terms.Postings(id))
+			}
+			if i == 0 {
+				result = union(lists)
+			} else {
+				result = snapshot.Intersect(result, union(lists))
+			}
+		}
+		return result, true
+	case esBool:
+		clauses := append(append([]esClause{}, c.Must...), c.Filter...)
+		result, narrowed := q.stab(clauses)
+		for _, v := range clauses {
+			if docs, ok := q.candidates(v); ok {
+				if narrowed {
+					result = snapshot.Intersect(result, docs)
+				} else {
+					result = docs
+				}
+				narrowed = true
+			}
+		}
+		if narrowed || len(c.Must)+len(c.Filter) > 0 || len(c.Should) == 0 {
+			return result, narrowed
+		}
+		var lists [][]int
+		for _, v := range c.Should {
+			docs, ok := q.candidates(v)
+			if !ok {
+				return nil, false
+			}
+			lists = append(lists, docs)
+		}
+		return union(lists), true
+	case esFunctionScore:
+		return q.candidates(c.Query)
+	}
+	return nil, false
+}
+
+func (q *memoryQuery) termCandidates(field string, values []interface{}) ([]int, bool) {
+	var lists [][]int
+	terms, ok := q.index.keys[field]
+	if text, isText := q.index.terms[field]; isText {
+		terms, ok = text.Terms, true
+	}
+	if !ok {
+		return nil, false
+	}
+	for _, v := range values {
+		if id, ok := terms.Find(memoryString(v)); ok {
+			lists = append(lists, terms.Postings(id))
+		}
+	}
+	return union(lists), true
+}
+
+// stab answers the start_ip <= ip <= end_ip pair of range clauses of the geo query from the ranges.
+func (q *memoryQuery) stab(clauses []esClause) ([]int, bool) {
+	var lte, gte interface{}
+	for _, v := range clauses {
+		if r, ok := v.(esRange); ok && r.Field == "start_ip" && r.Gte == nil {
+			lte = r.Lte
+		} else if ok && r.Field == "end_ip" && r.Lte == nil {
+			gte = r.Gte
+		}
+	}
+	if q.index.ranges == nil || lte == nil || gte == nil || memoryString(lte) != memoryString(gte) {
+		return nil, false
+	}
+	ip := net.ParseIP(memoryString(lte))
+	if ip == nil {
+		return nil, false
+	}
+	return q.index.ranges.stab(ip.To16()), true
+}
+
+// match reports whether a document matches the clause and its score, names of the matched named
+// queries are collected in q.named.
+func (q *memoryQuery) match(clause esClause, pos int) (bool, float64) {
+	switch c := clause.(type) {
+	case esTerm:
+		return q.matchValues(pos, c.Field, func(v interface{}) bool { return memoryEqual(v, c.Value) }), 1
+	case esTerms:
+		values := memoryList(c.Values)
+		return q.matchValues(pos, c.Field, func(v interface{}) bool {
+			for _, value := range values {
+				if memoryEqual(v, value) {
+					return true
+				}
+			}
+			return false
+		}), 1
+	case esPrefix:
+		return q.matchValues(pos, c.Field, func(v interface{}) bool { return strings.HasPrefix(memoryString(v), c.Value) }), 1
+	case esWildcard:
+		pattern := q.pattern(c.Value)
+		return q.matchValues(pos, c.Field, func(v interface{}) bool { return pattern.MatchString(memoryString(v)) }), 1
+	case esMatch:
+		tokens := q.index.tokens(pos, c.Field)
+		query := snapshot.Analyze(c.Query)
+		found := 0
+		for _, token := range query {
+			for _, v := range tokens {
+				if fuzzyEqual(token, v, c.Fuzziness, c.PrefixLength) {
+					found++
+					break
+				}
+			}
+		}
+		if found == 0 || c.Operator == "and" && found < len(query) {
+			return false, 0
+		}
+		// shorter fields score higher, as the length norm of BM25 does
+		return true, float64(found) / math.Sqrt(float64(len(tokens)))
+	case esRange:
+		return q.matchValues(pos, c.Field, func(v interface{}) bool {
+			return (c.Gte == nil || memoryCompare(c.Field, v, c.Gte) >= 0) && (c.Lte == nil || memoryCompare(c.Field, v, c.Lte) <= 0)
+		}), 1
+	case esExists:
+		return len(q.index.values(pos, c.Field)) > 0, 1
+	case esGeoDistance:
+		point := geoPointFromString(memoryString(q.index.firstValue(pos, c.Field)))
+		radius, err := strconv.ParseFloat(strings.TrimSuffix(c.Distance, "km"), 64)
+		return point != nil && err == nil && geoDistance(*point, c.Point) <= radius, 1
+	case esBool:
+		return q.matchBool(c, pos)
+	case esFunctionScore:
+		matched, score := q.match(c.Query, pos)
+		if !matched {
+			return false, 0
+		}
+		// score_mode multiply: weights of all matching functions, 1 when none matches
+		factor := 1.0
+		for _, function := range c.Functions {
+			if ok, _ := q.match(function.Filter, pos); ok {
+				factor *= float64(function.Weight)
+			}
+		}
+		switch c.BoostMode {
+		case "replace":
+			return true, factor
+		case "sum":
+			return true, score + factor
+		}
+		return true, score * factor
+	}
+	return false, 0
+}
+
+func (q *memoryQuery) matchBool(c esBool, pos int) (bool, float64) {
+	score := 0.0
+	for _, v := range c.Must {
+		matched, s := q.match(v, pos)
+		if !matched {
+			return false, 0
+		}
+		score += s
+	}
+	for _, v := range c.Filter {
+		if matched, _ := q.match(v, pos); !matched {
+			return false, 0
+		}
+	}
+	for _, v := range c.MustNot {
+		if matched, _ := q.match(v, pos); matched {
+			return false, 0
+		}
+	}
+	should := 0
+	for _, v := range c.Should {
+		if matched, s := q.match(v, pos); matched {
+			should++
+			score += s
+		}
+	}
+	// without must and filter at least one should clause has to match
+	if should == 0 && len(c.Should) > 0 && len(c.Must)+len(c.Filter) == 0 {
+		return false, 0
+	}
+	if len(c.Name) > 0 && !containsType(q.named, c.Name) {
+		q.named = append(q.named, c.Name)
+	}
+	return true, score
+}
+
+// matchValues checks the tokens of a text field and the values of other fields.
+func (q *memoryQuery) matchValues(pos int, field string, fn func(v interface{}) bool) bool {
+	if snapshot.TextFields[field] {
+		for _, v := range q.index.tokens(pos, field) {
+			if fn(v) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range q.index.values(pos, field) {
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *memoryQuery) pattern(wildcard string) *regexp.Regexp {
+	if pattern, ok := q.patterns[wildcard]; ok {
+		return pattern
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	escaped := false
+	for _, r := range wildcard {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			expr.WriteString(".*")
+		case r == '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	pattern := regexp.MustCompile(expr.String())
+	q.patterns[wildcard] = pattern
+	return pattern
+}
+
+// wildcardLiteral returns the longest part of a pattern without wildcards, prefixed with "^"
+// when the pattern starts with it.
+func wildcardLiteral(wildcard string) string {
+	var parts []string
+	var part strings.Builder
+	escaped := false
+	for _, r := range wildcard {
+		switch {
+		case escaped:
+			part.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*' || r == '?':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	parts = append(parts, part.String())
+	if len(parts[0]) > 0 {
+		return "^" + parts[0]
+	}
+	longest := ""
+	for _, v := range parts {
+		if utf8.RuneCountInString(v) > utf8.RuneCountInString(longest) {
+			longest = v
+		}
+	}
+	return longest
+}
+
+// lookup returns the ids of tokens that may contain the literal: a range of the sorted tokens for
+// a prefix, the trigram postings for a substring and all tokens for a literal shorter than a trigram.
+func (terms *memoryTerms) lookup(literal string) []int {
+	if strings.HasPrefix(literal, "^") {
+		return terms.prefix(literal[1:])
+	}
+	grams := trigrams(literal)
+	if len(grams) == 0 {
+		ids := make([]int, terms.Len())
+		for i := range ids {
+			ids[i] = i
+		}
+		return ids
+	}
+	ids := terms.grams[grams[0]]
+	for _, gram := range grams[1:] {
+		ids = snapshot.Intersect(ids, terms.grams[gram])
+	}
+	return ids
+}
+
+func (terms *memoryTerms) prefix(prefix string) []int {
+	from := sort.Search(terms.Len(), func(i int) bool { return terms.Token(i) >= prefix })
+	var ids []int
+	for i := from; i < terms.Len() && strings.HasPrefix(terms.Token(i), prefix); i++ {
+		ids = append(ids, i)
+	}
+	return ids
+}
+
+// fuzzy returns the ids of tokens within the allowed edits, prefixLength first letters must match.
+func (terms *memoryTerms) fuzzy(token string, fuzziness string, prefixLength int) []int {
+	if len(fuzziness) == 0 {
+		if id, ok := terms.Find(token); ok {
+			return []int{id}
+		}
+		return nil
+	}
+	runes := []rune(token)
+	if prefixLength > len(runes) {
+		prefixLength = len(runes)
+	}
+	var ids []int
+	for _, id := range terms.prefix(string(runes[:prefixLength])) {
+		if fuzzyEqual(token, terms.Token(id), fuzziness, prefixLength) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// fuzzyEqual follows fuzziness AUTO: exact up to 2 letters, 1 edit up to 5 and 2 edits after.
+func fuzzyEqual(a string, b string, fuzziness string, prefixLength int) bool {
+	if a == b {
+		return true
+	}
+	if len(fuzziness) == 0 {
+		return false
+	}
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < prefixLength || len(rb) < prefixLength || string(ra[:prefixLength]) != string(rb[:prefixLength]) {
+		return false
+	}
+	edits := 2
+	switch {
+	case fuzziness != "AUTO":
+		edits, _ = strconv.Atoi(fuzziness)
+	case len(ra) <= 2:
+		edits = 0
+	case len(ra) <= 5:
+		edits = 1
+	}
+	return editDistance(ra, rb) <= edits
+}
+
+func editDistance(a []rune, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// suggest works as the term suggester with suggest_mode missing: options only for the words that
+// are not in the index, up to 2 edits, the first letter must match.
+func (q *memoryQuery) suggest(suggest esTermSuggest) []suggestEntry {
+	var entries []suggestEntry
+	terms := q.index.terms[suggest.Term.Field]
+	offset := 0
+	text := strings.ToLower(suggest.Text)
+	for _, token := range snapshot.Analyze(suggest.Text) {
+		entry := suggestEntry{Text: token, Length: utf8.RuneCountInString(token)}
+		if i := strings.Index(text[offset:], token); i >= 0 {
+			entry.Offset = utf8.RuneCountInString(text[:offset+i])
+			offset += i + len(token)
+		}
+		if terms == nil || entry.Length < 4 {
+			entries = append(entries, entry)
+			continue
+		}
+		if _, found := terms.Find(token); !found {
+			runes := []rune(token)
+			for _, id := range terms.prefix(string(runes[:1])) {
+				candidate := []rune(terms.Token(id))
+				distance := editDistance(runes, candidate)
+				if distance > 2 {
+					continue
+				}
+				var option struct {
+					Text  string  `json:"text"`
+					Score float64 `json:"score"`
+					Freq  int     `json:"freq"`
+				}
+				option.Text = terms.Token(id)
+				option.Score = 1 - float64(distance)/float64(len(runes))
+				option.Freq = len(terms.Postings(id))
+				entry.Options = append(entry.Options, option)
+			}
+			sort.SliceStable(entry.Options, func(i, j int) bool {
+				if entry.Options[i].Score != entry.Options[j].Score {
+					return entry.Options[i].Score > entry.Options[j].Score
+				}
+				return entry.Options[i].Freq > entry.Options[j].Freq
+			})
+			if len(entry.Options) > 5 {
+				entry.Options = entry.Options[:5]
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// sort orders hits like Elasticsearch: by the sort fields, missing values last, ties in index order.
+func (q *memoryQuery) sort(hits []memoryHit, fields []interface{}) {
+	if len(fields) == 0 {
+		fields = []interface{}{"_score"}
+	}
+	for i := range hits {
+		pos := hits[i].pos
+		for _, field := range fields {
+			switch f := field.(type) {
+			case esSortField:
+				hits[i].sort = append(hits[i].sort, q.index.firstValue(pos, f.Field))
+			case esGeoSort:
+				distance := math.Inf(1)
+				if point := geoPointFromString(memoryString(q.index.firstValue(pos, f.Field))); point != nil {
+					distance = geoDistance(*point, f.Point)
+				}
+				hits[i].sort = append(hits[i].sort, distance)
+			default:
+				hits[i].sort = append(hits[i].sort, hits[i].score)
+			}
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		for k, field := range fields {
+			a, b := hits[i].sort[k], hits[j].sort[k]
+			if a == nil || b == nil {
+				if (a == nil) != (b == nil) {
+					return b == nil
+				}
+				continue
+			}
+			cmp := memoryCompare("", a, b)
+			if cmp == 0 {
+				continue
+			}
+			switch f := field.(type) {
+			case esSortField:
+				return f.Order == "desc" && cmp > 0 || f.Order != "desc" && cmp < 0
+			case esGeoSort:
+				return cmp < 0
+			}
+			return cmp > 0
+		}
+		return false
+	})
+}
+
+// geoDistance is the arc distance in km, as the geo_distance query computes it.
+func geoDistance(a geoPoint, b geoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.Lon-a.Lon)*math.Pi/180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * 6371.0088 * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func firstOf(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+func memoryList(values interface{}) []interface{} {
+	var list []interface{}
+	switch v := values.(type) {
+	case []string:
+		for _, s := range v {
+			list = append(list, s)
+		}
+	case []int:
+		for _, i := range v {
+			list = append(list, i)
+		}
+	case []interface{}:
+		list = v
+	default:
+		list = append(list, v)
+	}
+	return list
+}
+
+func memoryString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func memoryFloat(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	}
+	f, err := strconv.ParseFloat(memoryString(v), 64)
+	return f, err == nil
+}
+
+func memoryEqual(docValue interface{}, value interface{}) bool {
+	if _, ok := docValue.(float64); ok {
+		return memoryCompare("", docValue, value) == 0
+	}
+	return memoryString(docValue) == memoryString(value)
+}
+
+// memoryCompare compares ip fields as addresses, numbers as numbers and the rest as strings.
+func memoryCompare(field string, a interface{}, b interface{}) int {
+	if memoryIPFields[field] {
+		ipA, ipB := net.ParseIP(memoryString(a)), net.ParseIP(memoryString(b))
+		if ipA != nil && ipB != nil {
+			return bytes.Compare(ipA.To16(), ipB.To16())
+		}
+	}
+	fa, okA := memoryFloat(a)
+	fb, okB := memoryFloat(b)
+	if okA && okB {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(memoryString(a), memoryString(b))
+}
+
+func union(lists [][]int) []int {
+	seen := make(map[int]bool)
+	var result []int
+	for _, list := range lists {
+		for _, v := range list {
+			if !seen[v] {
+				seen[v] = true
+				result = append(result, v)
+			}
+		}
+	}
+	sort.Ints(result)
+	return result
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+func memoryFixture(t *testing.T) *memorySearcher {
+	t.Helper()
+	searcher, err := newMemorySearcher(map[string]string{
+		indexKladr: "testdata/memory/kladr.jsonl",
+		indexGeo:   "testdata/memory/geo.jsonl",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return searcher
+}
+
+type memoryHitWant struct {
+	id      int
+	score   float64
+	matched []string
+}
+
+func checkHits(t *testing.T, name string, resp searchResponse, total int, want []memoryHitWant) {
+	t.Helper()
+	if resp.Hits.Total.Value != total || resp.Hits.Total.Relation != "eq" {
+		t.Errorf("%s: total %+v, want %d", name, resp.Hits.Total, total)
+	}
+	if len(resp.Hits.Hits) != len(want) {
+		t.Fatalf("%s: %d hits, want %d", name, len(resp.Hits.Hits), len(want))
+	}
+	for i, hit := range resp.Hits.Hits {
+		if id := fastjson.GetInt(hit.Source, "doc_id"); id != want[i].id {
+			t.Errorf("%s: hit %d is doc %d, want %d", name, i, id, want[i].id)
+		}
+		if hit.Score != nil && want[i].score != 0 && *hit.Score != want[i].score {
+			t.Errorf("%s: hit %d score %v, want %v", name, i, *hit.Score, want[i].score)
+		}
+		if !reflect.DeepEqual(hit.MatchedQueries, want[i].matched) {
+			t.Errorf("%s: hit %d matched %v, want %v", name, i, hit.MatchedQueries, want[i].matched)
+		}
+	}
+}
+
+func TestMemoryLocalityQueries(t *testing.T) {
+	rowCount, listRowCount = 10, 20
+	searcher := memoryFixture(t)
+	tests := []struct {
+		name  string
+		uri   string
+		total int
+		hits  []memoryHitWant
+	}{
+		// cities go before settlements by the function_score weights
+		{"term", "/locality?term=тюм", 2, []memoryHitWant{{2, 200, nil}, {4, 100, nil}}},
+		{"iterm", "/api/locality?iterm=мен", 2, []memoryHitWant{{2, 200, nil}, {4, 100, nil}}},
+		{"two_words", "/locality?term=нижняя тав", 1, []memoryHitWant{{9, 1, nil}}},
+		// "р-н" is analyzed as a text field, so the district doesn't pass the terms filter like in Elasticsearch
+		{"search", "/api/kladr/for_select?search=тюм", 3, []memoryHitWant{{2, 200, nil}, {1, 170, nil}, {4, 100, nil}}},
+		// without functions the scores tie and status decides
+		{"cities_and_regions", "/api/kladr/for_select?search=т&cities_and_regions=1", 3, []memoryHitWant{{2, 1, nil}, {3, 1, nil}, {1, 1, nil}}},
+		{"region_code", "/locality?term=майкоп&region_code=01", 1, []memoryHitWant{{6, 200, nil}}},
+		{"region_code_other", "/locality?term=майкоп&region_code=72", 0, nil},
+		{"translit", "/locality?term=tyumen", 2, []memoryHitWant{{2, 200, nil}, {4, 100, nil}}},
+		{"fuzzy_strict", "/locality?term=тюм&fuzzy=1", 2, []memoryHitWant{{2, 0, []string{"strict"}}, {4, 0, []string{"strict"}}}},
+		{"fuzzy_typo", "/locality?term=тюминь&fuzzy=1", 1, []memoryHitWant{{2, 200, nil}}},
+	}
+	for _, test := range tests {
+		ctx := requestCtx(test.uri)
+		query, ok := generateQuery(ctx, searchTerm(ctx))
+		if !ok {
+			t.Fatalf("%s: no query", test.name)
+		}
+		resp, err := searcher.Search(indexKladr, query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkHits(t, test.name, resp, test.total, test.hits)
+	}
+}
+
+func TestMemoryMatchedQueries(t *testing.T) {
+	searcher := memoryFixture(t)
+	ctx := requestCtx("/locality?term=тюм&fuzzy=1")
+	query, _ := generateQuery(ctx, searchTerm(ctx))
+	resp, err := searcher.Search(indexKladr, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strictFound(ctx, resp, len(resp.Hits.Hits)) {
+		t.Error("strict match not reported")
+	}
+	ctx = requestCtx("/locality?term=тюминь&fuzzy=1")
+	query, _ = generateQuery(ctx, searchTerm(ctx))
+	resp, err = searcher.Search(indexKladr, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strictFound(ctx, resp, len(resp.Hits.Hits)) {
+		t.Error("fuzzy match reported as strict")
+	}
+}
+
+func TestMemorySuggest(t *testing.T) {
+	searcher := memoryFixture(t)
+	resp, err := searcher.Search(indexKladr, querySuggest("тюминь"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := resp.Suggest["name"]
+	if len(entries) != 1 || entries[0].Text != "тюминь" || len(entries[0].Options) == 0 || entries[0].Options[0].Text != "тюмень" {
+		t.Errorf("suggest %+v", entries)
+	}
+	resp, err = searcher.Search(indexKladr, querySuggest("тюмень"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// suggest_mode missing has no options for a word in the index
+	if entries := resp.Suggest["name"]; len(entries) != 1 || len(entries[0].Options) != 0 {
+		t.Errorf("suggest %+v", entries)
+	}
+}
+
+func TestMemoryTermsAndPaging(t *testing.T) {
+	searcher := memoryFixture(t)
+	resp, err := searcher.Search(indexKladr, queryChildren(7, nil, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// status desc, then doc_id asc: 4 and 9 have the same status
+	checkHits(t, "children", resp, 2, []memoryHitWant{{9, 0, nil}})
+	if strings.Contains(string(resp.Hits.Hits[0].Source), "ancestors") {
+		t.Error("ancestors not excluded")
+	}
+	resp, err = searcher.Search(indexKladr, queryByID(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHits(t, "by_id", resp, 1, []memoryHitWant{{2, 0, nil}})
+	if !strings.Contains(string(resp.Hits.Hits[0].Source), "ancestors") {
+		t.Error("ancestors missing")
+	}
+	resp, err = searcher.Search(indexKladr, queryCode("7201900005200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHits(t, "code", resp, 1, []memoryHitWant{{4, 0, nil}})
+}
+
+func TestMemoryGeoRanges(t *testing.T) {
+	searcher := memoryFixture(t)
+	tests := []struct {
+		ip    string
+		total int
+		city  string
+	}{
+		{"10.1.2.3", 2, "Тюмень"},
+		{"10.2.0.1", 1, "Тюмень"},
+		// the DE range is outside the country filter
+		{"11.1.1.1", 0, ""},
+		{"12.0.0.1", 0, ""},
+	}
+	for _, test := range tests {
+		resp, err := searcher.Search(indexGeo, queryGeo(test.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Hits.Total.Value != test.total {
+			t.Errorf("%s: total %d, want %d", test.ip, resp.Hits.Total.Value, test.total)
+		}
+		city := ""
+		if len(resp.Hits.Hits) > 0 {
+			city = fastjson.GetString(resp.Hits.Hits[0].Source, "city")
+		}
+		if city != test.city {
+			t.Errorf("%s: city %q, want %q", test.ip, city, test.city)
+		}
+	}
+}
+
+func TestMemoryRejectsBadQuery(t *testing.T) {
+	searcher := memoryFixture(t)
+	if _, err := searcher.Search(indexKladr, queryReverse(geoPoint{Lat: math.NaN(), Lon: 0})); err == nil {
+		t.Error("query with NaN accepted")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Typed model of the Elasticsearch query DSL used by the handlers. Every clause is written by
+// encoding/json, so quotes and backslashes in user input can't change the shape of a query.
+
+type esClause interface {
+	json.Marshaler
+}
+
+type esSearch struct {
+	Query   esClause                 `json:"query,omitempty"`
+	Suggest map[string]esTermSuggest `json:"suggest,omitempty"`
+	Sort    []interface{}            `json:"sort,omitempty"`
+	Source  *esSource                `json:"_source,omitempty"`
+	Size    int                      `json:"size"`
+	From    int                      `json:"from"`
+}
+
+type esSource struct {
+	Excludes []string `json:"excludes"`
+}
+
+type esTermSuggest struct {
+	Text string `json:"text"`
+	Term struct {
+		Field       string `json:"field"`
+		SuggestMode string `json:"suggest_mode"`
+	} `json:"term"`
+}
+
+type esTerm struct {
+	Field string
+	Value interface{}
+}
+
+type esTerms struct {
+	Field  string
+	Values interface{}
+}
+
+type esPrefix struct {
+	Field string
+	Value string
+}
+
+type esWildcard struct {
+	Field string
+	Value string
+}
+
+type esMatch struct {
+	Field        string
+	Query        string
+	Fuzziness    string
+	PrefixLength int
+	Operator     string
+}
+
+type esRange struct {
+	Field string
+	Gte   interface{}
+	Lte   interface{}
+}
+
+type esExists struct {
+	Field string
+}
+
+type esGeoDistance struct {
+	Field    string
+	Distance string
+	Point    geoPoint
+}
+
+type esBool struct {
+	Name    string     `json:"_name,omitempty"`
+	Must    []esClause `json:"must,omitempty"`
+	Should  []esClause `json:"should,omitempty"`
+	Filter  []esClause `json:"filter,omitempty"`
+	MustNot []esClause `json:"must_not,omitempty"`
+}
+
+type esFunctionScore struct {
+	Query     esClause     `json:"query"`
+	Functions []esFunction `json:"functions,omitempty"`
+	BoostMode string       `json:"boost_mode,omitempty"`
+}
+
+type esFunction struct {
+	Filter esClause `json:"filter"`
+	Weight int      `json:"weight"`
+}
+
+type esSortField struct {
+	Field string
+	Order string
+}
+
+type esGeoSort struct {
+	Field string
+	Point geoPoint
+}
+
+var excludeAncestors = &esSource{Excludes: []string{"ancestors"}}
+
+var wildcardReplacer = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+
+func esObject(key string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{key: value}
+}
+
+func (c esTerm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject("term", esObject(c.Field, c.Value)))
+}
+
+func (c esTerms) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject("terms", esObject(c.Field, c.Values)))
+}
+
+func (c esPrefix) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject("prefix", esObject(c.Field, c.Value)))
+}
+
+func (c esWildcard) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject("wildcard", esObject(c.Field, c.Value)))
+}
+
+func (c esMatch) MarshalJSON() ([]byte, error) {
+	body := struct {
+		Query        string `json:"query"`
+		Fuzziness    string `json:"fuzziness,omitempty"`
+		PrefixLength int    `json:"prefix_length,omitempty"`
+		Operator     string `json:"operator,omitempty"`
+	}{c.Query, c.Fuzziness, c.PrefixLength, c.Operator}
+	return json.Marshal(esObject("match", esObject(c.Field, body)))
+}
+
+func (c esRange) MarshalJSON() ([]byte, error) {
+	body := struct {
+		Gte interface{} `json:"gte,omitempty"`
+		Lte interface{} `json:"lte,omitempty"`
+	}{c.Gte, c.Lte}
+	return json.Marshal(esObject("range", esObject(c.Field, body)))
+}
+
+func (c esExists) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject("exists", esObject("field", c.Field)))
+}
+
+func (c esGeoDistance) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject("geo_distance", map[string]interface{}{"distance": c.Distance, c.Field: c.Point}))
+}
+
+func (c esBool) MarshalJSON() ([]byte, error) {
+	type body esBool
+	return json.Marshal(esObject("bool", body(c)))
+}
+
+func (c esFunctionScore) MarshalJSON() ([]byte, error) {
+	type body esFunctionScore
+	return json.Marshal(esObject("function_score", body(c)))
+}
+
+func (c esSortField) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject(c.Field, esObject("order", c.Order)))
+}
+
+func (c esGeoSort) MarshalJSON() ([]byte, error) {
+	return json.Marshal(esObject("_geo_distance", map[string]interface{}{c.Field: c.Point, "order": "asc", "unit": "km"}))
+}
+
+// queryError is a query that can't be encoded, the handlers answer 400 for it instead of sending
+// an empty body that Elasticsearch takes as match_all.
+type queryError struct {
+	err error
+}
+
+func (e queryError) Error() string {
+	return "Query can't be built: " + e.err.Error()
+}
+
+func (search esSearch) String() (string, error) {
+	body, err := json.Marshal(search)
+	if err != nil {
+		return "", queryError{err}
+	}
+	return string(body), nil
+}
+
+// escapeWildcard keeps * and ? typed by a user from acting as wildcards.
+func escapeWildcard(a string) string {
+	return wildcardReplacer.Replace(a)
+}
+
+// Sorting used by the lists: higher status (region and district centers) first, then by id.
+var statusSort = []interface{}{esSortField{"status", "desc"}, esSortField{"doc_id", "asc"}}
+
+func queryByID(id int) esSearch {
+	return esSearch{Query: esTerm{"doc_id", id}, Size: 1}
+}
+
+func queryKladrID(id int) esSearch {
+	return esSearch{Query: esTerm{"doc_id", id}, Source: excludeAncestors, Size: 1}
+}
+
+func queryChildren(id int, types []string, size int, from int) esSearch {
+	query := esBool{Must: []esClause{esTerm{"parent_id", id}}}
+	if len(types) > 0 {
+		query.Must = append(query.Must, esTerms{"locality_title", types})
+	}
+	return esSearch{Query: query, Sort: statusSort, Source: excludeAncestors, Size: size, From: from}
+}
+
+func queryCode(code string) esSearch {
+	return esSearch{Query: esBool{Should: []esClause{esTerm{"code", code}, esTerm{"alt_codes", code}}}, Source: excludeAncestors, Size: 1}
+}
+
+func queryStrCode(code string) esSearch {
+	return esSearch{Query: esBool{Should: []esClause{esTerm{"code", code}, esTerm{"alt_codes", code}}}, Size: 1}
+}
+
+func queryPostcode(index string) esSearch {
+	return esSearch{Query: esTerm{"postcode", index}, Sort: statusSort, Source: excludeAncestors, Size: 100}
+}
+
+func queryOkato(field string, code string, prefix bool, size int, from int) esSearch {
+	var query esClause = esTerm{field, code}
+	if prefix {
+		query = esPrefix{field, code}
+	}
+	return esSearch{Query: query, Sort: statusSort, Source: excludeAncestors, Size: size, From: from}
+}
+
+func querySuggest(text string) esSearch {
+	var suggest esTermSuggest
+	suggest.Text = text
+	suggest.Term.Field = "locality_name"
+	suggest.Term.SuggestMode = "missing"
+	return esSearch{Suggest: map[string]esTermSuggest{"name": suggest}}
+}
+
+func queryParse(field string, name string, filters ...esClause) esSearch {
+	query := esBool{Must: append([]esClause{esMatch{Field: field, Query: name, Operator: "and"}}, filters...)}
+	return esSearch{Query: query, Sort: []interface{}{"_score"}, Source: excludeAncestors, Size: 5}
+}
+
+func queryRegions() esSearch {
+	return esSearch{Query: esTerm{"region_id", 0}, Source: excludeAncestors, Size: 1000}
+}
+
+func queryRegionChildren(ids []int) esSearch {
+	return esSearch{Query: esTerms{"parent_id", ids}, Source: excludeAncestors, Size: 10000}
+}
+
+func queryReverse(point geoPoint) esSearch {
+	query := esBool{Filter: []esClause{esExists{"location"}}}
+	return esSearch{Query: query, Sort: []interface{}{esGeoSort{"location", point}}, Source: excludeAncestors, Size: 1}
+}
+
+func queryNearby(types esClause, radius string, point geoPoint, excludeID int, size int) esSearch {
+	query := esBool{
+		Must:    []esClause{types},
+		Filter:  []esClause{esGeoDistance{"location", radius + "km", point}},
+		MustNot: []esClause{esTerm{"doc_id", excludeID}},
+	}
+	return esSearch{Query: query, Sort: []interface{}{esGeoSort{"location", point}}, Source: excludeAncestors, Size: size}
+}
+
+func queryGeo(ip string) esSearch {
+	query := esBool{Must: []esClause{esMatch{Field: "country", Query: "RU"}, esRange{Field: "start_ip", Lte: ip}, esRange{Field: "end_ip", Gte: ip}}}
+	return esSearch{Query: query, Size: 1}
+}
+
+func queryStreet(term []esClause, localityID int, size int) esSearch {
+	query := esBool{Must: append(term, esTerm{"locality_id", localityID})}
+	return esSearch{Query: query, Sort: []interface{}{"_score"}, Size: size}
+}
+
+func queryHouse(streetID int) esSearch {
+	return esSearch{Query: esTerm{"street_id", streetID}, Size: 500}
+}
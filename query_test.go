@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+func requestCtx(uri string) *fasthttp.RequestCtx {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI(uri)
+	return &ctx
+}
+
+// golden compares the body with testdata/<name>.json, go test -update writes the files.
+func golden(t *testing.T, name string, body string) {
+	t.Helper()
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(body), "", "  "); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	indented.WriteByte('\n')
+	path := filepath.Join("testdata", name+".json")
+	if *update {
+		if err := ioutil.WriteFile(path, indented.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(indented.Bytes(), want) {
+		t.Errorf("%s: body differs from %s:\n%s", name, path, indented.String())
+	}
+}
+
+func TestGenerateQuery(t *testing.T) {
+	rowCount, listRowCount = 10, 20
+	tests := []struct {
+		name string
+		uri  string
+	}{
+		{"term", "/locality?term=Тюм"},
+		{"term_two_words", "/locality?term=нижний новгород"},
+		{"term_wildcard_chars", "/locality?term=тю*м?"},
+		{"iterm", "/api/locality?iterm=мен"},
+		{"search", "/api/kladr/for_select?search=тюм"},
+		{"search_page", "/api/kladr/for_select?search=тюм&page=3"},
+		{"regions_only", "/api/kladr/for_select?search=тюм&regions_only=1"},
+		{"cities_and_regions", "/api/kladr/for_select?search=тюм&cities_and_regions=1"},
+		{"fuzzy", "/locality?term=тюминь&fuzzy=1"},
+		{"region_id", "/locality?term=тюм&region_id=168104"},
+		{"region_code", "/locality?term=тюм&region_code=01"},
+		{"postcode", "/locality?term=тюм&postcode=625000"},
+		{"okato", "/locality?term=тюм&okato=71401"},
+		{"oktmo_search", "/api/kladr/for_select?search=тюм&oktmo=71701000001"},
+		{"translit", "/locality?term=tyumen"},
+		{"translit_iterm_fuzzy", "/api/locality?iterm=nizhniy&fuzzy=1"},
+	}
+	for _, test := range tests {
+		ctx := requestCtx(test.uri)
+		query, ok := generateQuery(ctx, searchTerm(ctx))
+		if !ok {
+			t.Errorf("%s: no query", test.name)
+			continue
+		}
+		body, err := query.String()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		golden(t, filepath.Join("query", test.name), body)
+	}
+}
+
+func TestGenerateQueryRejectsFilters(t *testing.T) {
+	for _, uri := range []string{
+		"/locality?term=тюм&region_id=abc",
+		"/locality?term=тюм&region_code=99999999999999999999",
+		"/locality?term=тюм&postcode=62500",
+		"/locality?term=тюм&okato=7140a",
+		"/locality?term=тюм&oktmo=123456789012",
+	} {
+		ctx := requestCtx(uri)
+		if _, ok := generateQuery(ctx, searchTerm(ctx)); ok {
+			t.Errorf("%s: query built for a bad filter", uri)
+		}
+	}
+}
+
+func TestQueryStringError(t *testing.T) {
+	_, err := queryReverse(geoPoint{Lat: math.NaN(), Lon: 1}).String()
+	if _, ok := err.(queryError); !ok {
+		t.Errorf("want queryError, got %v", err)
+	}
+}
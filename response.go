@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Typed model of an Elasticsearch search response. Documents stay raw in searchHit.Source and are
+// read by docDateFromSource and friends, everything around them is decoded here.
+
+type searchResponse struct {
+	Took         int                        `json:"took"`
+	TimedOut     bool                       `json:"timed_out"`
+	Shards       searchShards               `json:"_shards"`
+	Hits         searchHits                 `json:"hits"`
+	Aggregations map[string]json.RawMessage `json:"aggregations"`
+	Suggest      map[string][]suggestEntry  `json:"suggest"`
+}
+
+type searchShards struct {
+	Total      int            `json:"total"`
+	Successful int            `json:"successful"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Failures   []shardFailure `json:"failures"`
+}
+
+type shardFailure struct {
+	Shard  int    `json:"shard"`
+	Index  string `json:"index"`
+	Reason struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"reason"`
+}
+
+type searchHits struct {
+	Total    searchTotal `json:"total"`
+	MaxScore *float64    `json:"max_score"`
+	Hits     []searchHit `json:"hits"`
+}
+
+// searchTotal is {"value":N,"relation":"eq"} since ES 7 and a bare number before it,
+// relation "gte" means the real count is above value (track_total_hits limit).
+type searchTotal struct {
+	Value    int    `json:"value"`
+	Relation string `json:"relation"`
+}
+
+type searchHit struct {
+	Index          string          `json:"_index"`
+	ID             string          `json:"_id"`
+	Score          *float64        `json:"_score"`
+	Source         json.RawMessage `json:"_source"`
+	Sort           []interface{}   `json:"sort"`
+	MatchedQueries []string        `json:"matched_queries"`
+}
+
+type suggestEntry struct {
+	Text    string `json:"text"`
+	Offset  int    `json:"offset"`
+	Length  int    `json:"length"`
+	Options []struct {
+		Text  string  `json:"text"`
+		Score float64 `json:"score"`
+		Freq  int     `json:"freq"`
+	} `json:"options"`
+}
+
+func (total *searchTotal) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '{' {
+		total.Relation = "eq"
+		return json.Unmarshal(data, &total.Value)
+	}
+	type body searchTotal
+	return json.Unmarshal(data, (*body)(total))
+}
+
+// decodeSearch fails on a timed out search or failed shards as well, ES answers 200 with a
+// partial result then and an empty page would look like "nothing found".
+func decodeSearch(data []byte) (searchResponse, error) {
+	var resp searchResponse
+	if len(bytes.TrimSpace(data)) == 0 {
+		return resp, errors.New("Elastic Response Error: empty body")
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, err
+	}
+	if resp.TimedOut {
+		return resp, fmt.Errorf("Elastic Response Error: search timed out after %d ms", resp.Took)
+	}
+	if resp.Shards.Failed > 0 {
+		reason := "unknown reason"
+		if len(resp.Shards.Failures) > 0 {
+			failure := resp.Shards.Failures[0]
+			reason = failure.Index + ": " + failure.Reason.Type + ": " + failure.Reason.Reason
+		}
+		return resp, fmt.Errorf("Elastic Response Error: %d of %d shards failed, %s", resp.Shards.Failed, resp.Shards.Total, reason)
+	}
+	return resp, nil
+}
+
+// matched reports whether the named query matched at least one hit.
+func (resp searchResponse) matched(name string) bool {
+	for _, hit := range resp.Hits.Hits {
+		for _, v := range hit.MatchedQueries {
+			if v == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Searcher runs a query against one of the indices, the handlers don't know whether it's
+// Elasticsearch or the in-memory backend behind it.
+type Searcher interface {
+	Search(index string, query esSearch) (searchResponse, error)
+	Ping() error
+}
+
+const (
+	indexKladr  = "kladr"
+	indexStreet = "street"
+	indexHouse  = "house"
+	indexGeo    = "geoip"
+)
+
+type elasticSearcher struct {
+	urls map[string]string
+}
+
+func (searcher elasticSearcher) Search(index string, query esSearch) (searchResponse, error) {
+	body, err := query.String()
+	if err != nil {
+		return searchResponse{}, err
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(searcher.urls[index] + "/_search")
+	req.Header.SetContentType("application/json")
+	req.Header.SetConnectionClose()
+	req.Header.SetMethod("POST")
+	req.SetBodyString(body)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	client := &fasthttp.Client{}
+	if err := client.Do(req, resp); err != nil {
+		return searchResponse{}, err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return searchResponse{}, errors.New("Elastic Response Error: " + string(resp.Body()))
+	}
+	return decodeSearch(resp.Body())
+}
+
+func (searcher elasticSearcher) Ping() error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(searcher.urls[indexKladr])
+	req.Header.SetConnectionClose()
+	req.Header.SetMethod("GET")
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	client := &fasthttp.Client{MaxIdleConnDuration: time.Second}
+	client.Do(req, resp)
+	if resp.StatusCode() == fasthttp.StatusNotFound {
+		return errors.New("Elastic Index KLADR not available")
+	}
+	if resp.StatusCode() != fasthttp.StatusOK || resp.Header.ContentLength() == 0 {
+		return errors.New("No connection to Elastic")
+	}
+	return nil
+}
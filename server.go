@@ -2,9 +2,10 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"regexp"
@@ -17,14 +18,37 @@ import (
 	"github.com/lab259/cors"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fastjson"
+
+	"kladr/snapshot"
 )
 
 type docDate struct {
 	ID           int          `json:"id"`
+	Code         string       `json:"code,omitempty"`
+	Postcode     string       `json:"postcode,omitempty"`
+	Okato        string       `json:"okato,omitempty"`
+	Oktmo        string       `json:"oktmo,omitempty"`
 	Status       int          `json:"-"`
 	FullName     string       `json:"title"`
+	TitleLatin   string       `json:"title_latin,omitempty"`
 	LocalityType localityType `json:"locality_type"`
 	Region       interface{}  `json:"region"`
+	Ancestors    []ancestor   `json:"ancestors,omitempty"`
+	Location     *geoPoint    `json:"location,omitempty"`
+	Distance     *float64     `json:"distance_km,omitempty"`
+	Corrected    bool         `json:"corrected,omitempty"`
+}
+
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type ancestor struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status int    `json:"status"`
 }
 
 type localityType struct {
@@ -38,44 +62,135 @@ type region struct {
 	RegionCode  int    `json:"region_code"`
 }
 
+type streetDate struct {
+	ID         int          `json:"id"`
+	Code       string       `json:"code,omitempty"`
+	FullName   string       `json:"title"`
+	StreetType localityType `json:"street_type"`
+	Locality   interface{}  `json:"locality"`
+}
+
+type streetLocality struct {
+	LocalityID    int    `json:"id"`
+	LocalityTitle string `json:"title"`
+}
+
+type houseDate struct {
+	StreetID int    `json:"street_id"`
+	House    string `json:"house"`
+	Found    bool   `json:"found"`
+	Postcode string `json:"postcode,omitempty"`
+	Okato    string `json:"okato,omitempty"`
+}
+
+type codeDate struct {
+	Code     string      `json:"code"`
+	Parts    codeParts   `json:"parts"`
+	Locality *docDate    `json:"locality,omitempty"`
+	Street   *streetDate `json:"street,omitempty"`
+}
+
+type codeParts struct {
+	Region     string `json:"region"`
+	District   string `json:"district"`
+	City       string `json:"city"`
+	Settlement string `json:"settlement"`
+	Street     string `json:"street,omitempty"`
+	Actuality  string `json:"actuality"`
+}
+
 type docList struct {
-	Count    int            `json:"count"`
-	Next     interface{}    `json:"next"`
-	Previous interface{}    `json:"previous"`
-	Result   []localityList `json:"results"`
+	Count      int            `json:"count"`
+	Next       interface{}    `json:"next"`
+	Previous   interface{}    `json:"previous"`
+	Result     []localityList `json:"results"`
+	Corrected  bool           `json:"corrected,omitempty"`
+	Suggestion string         `json:"suggestion,omitempty"`
+}
+
+// localityResult is the /locality answer with fuzzy=1, the plain answer is only the array.
+type localityResult struct {
+	Result     []docDate `json:"results"`
+	Suggestion string    `json:"suggestion,omitempty"`
+}
+
+type childrenList struct {
+	Count    int         `json:"count"`
+	Next     interface{} `json:"next"`
+	Previous interface{} `json:"previous"`
+	Result   []docDate   `json:"results"`
 }
 
 type localityList struct {
-	ID   int    `json:"id"`
-	Text string `json:"text"`
+	ID        int    `json:"id"`
+	Text      string `json:"text"`
+	TextLatin string `json:"text_latin,omitempty"`
 }
 
 var (
-	querySingle   string
-	queryCity     string
-	queryGeo      string
-	queryMultiple string
 	elasticURL    string
 	elasticGeoURL string
+	elasticStrURL string
+	elasticHseURL string
 	branch        string
+	trustedNets   []*net.IPNet
+	searcher      Searcher
 	rowCount      int
 	listRowCount  int
 )
 
 func getLocality(ctx *fasthttp.RequestCtx) {
 	start := time.Now()
-	var biteBody []byte
 	var docDates []docDate
-	query := generateQuery(ctx)
-	if len(query) > 0 {
-		biteBody = sendRequest(query)
-		if len(biteBody) > 0 {
-			docDates = resultFromJSON(biteBody)
+	var suggestion string
+	fuzzy := string(ctx.QueryArgs().Peek("fuzzy")) == "1"
+	termValue := searchTerm(ctx)
+	query, ok := generateQuery(ctx, termValue)
+	if ok {
+		resp, err := sendRequest(indexKladr, query)
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		docDates = resultFromHits(resp)
+		if fuzzy && !strictFound(ctx, resp, len(docDates)) {
+			suggestion = getSuggestion(termValue)
+		}
+		swapped, isSwapped := swapLayout(termValue)
+		if isSwapped && (len(docDates) == 0 || isLatinLayout(termValue)) {
+			query, _ = generateQuery(ctx, swapped)
+			resp, err = sendRequest(indexKladr, query)
+			if err != nil {
+				searchFailed(ctx, err)
+				return
+			}
+			for _, v := range resultFromHits(resp) {
+				if len(docDates) >= rowCount {
+					break
+				}
+				v.Corrected = true
+				docDates = append(docDates, v)
+			}
+		}
+	}
+	if scheme := latinScheme(ctx); len(scheme) > 0 {
+		for i := range docDates {
+			docDates[i].TitleLatin = translitTitle(docDates[i].FullName, scheme)
 		}
 	}
 	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", len(docDates), "; Time Spent: ", time.Since(start))
 	ctx.Response.Header.Set("Content-Type", "application/json")
-	if len(docDates) > 0 {
+	if fuzzy {
+		if docDates == nil {
+			docDates = []docDate{}
+		}
+		body, err := json.Marshal(localityResult{Result: docDates, Suggestion: suggestion})
+		if err != nil {
+			log.Print(err)
+			sentry.CaptureException(err)
+		}
+		fmt.Fprint(ctx, string(body))
+	} else if len(docDates) > 0 {
 		body, err := json.Marshal(docDates)
 		if err != nil {
 			log.Print(err)
@@ -92,7 +207,6 @@ func getLocalityList(ctx *fasthttp.RequestCtx) {
 	var err error
 	var pageNumber int = 1
 	var docList docList
-	var biteBody []byte
 	var regionsOnly string
 	host := string(ctx.Request.Host())
 	scheme := string(ctx.Request.URI().Scheme())
@@ -106,11 +220,33 @@ func getLocalityList(ctx *fasthttp.RequestCtx) {
 			pageNumber = 1
 		}
 	}
-	query := generateQuery(ctx)
-	if len(query) > 0 {
-		biteBody = sendRequest(query)
-		if len(biteBody) > 0 {
-			docList.Result, docList.Count = resultListFromJSON(biteBody)
+	termValue := searchTerm(ctx)
+	fuzzy := string(ctx.QueryArgs().Peek("fuzzy")) == "1"
+	query, ok := generateQuery(ctx, termValue)
+	if ok {
+		resp, err := sendRequest(indexKladr, query)
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		docList.Result, docList.Count = resultListFromHits(resp)
+		if fuzzy && !strictFound(ctx, resp, docList.Count) {
+			docList.Suggestion = getSuggestion(termValue)
+		}
+		if swapped, isSwapped := swapLayout(termValue); isSwapped && docList.Count == 0 {
+			query, _ = generateQuery(ctx, swapped)
+			resp, err = sendRequest(indexKladr, query)
+			if err != nil {
+				searchFailed(ctx, err)
+				return
+			}
+			docList.Result, docList.Count = resultListFromHits(resp)
+			docList.Corrected = docList.Count > 0
+		}
+	}
+	if scheme := latinScheme(ctx); len(scheme) > 0 {
+		for i := range docList.Result {
+			docList.Result[i].TextLatin = translitTitle(docList.Result[i].Text, scheme)
 		}
 	}
 	searchVal := url.QueryEscape(string(ctx.QueryArgs().Peek("search")))
@@ -135,45 +271,371 @@ func getLocalityList(ctx *fasthttp.RequestCtx) {
 		}
 	}
 	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", docList.Count, "; Time Spent: ", time.Since(start))
-	if docList.Count == 0 || (listRowCount*(pageNumber-1)) >= docList.Count {
+	if fuzzy && docList.Count == 0 {
+		// with fuzzy=1 an empty page still carries the suggestion
+		docList.Result = []localityList{}
+	} else if docList.Count == 0 || (listRowCount*(pageNumber-1)) >= docList.Count {
 		ctx.Error("not found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(docList)
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+func getLocalityByID(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var docDates []docDate
+	id := ctx.UserValue("id").(string)
+	// "nearby" can't be a separate route next to :id in fasthttprouter
+	if id == "nearby" {
+		getLocalityNearby(ctx)
+		return
+	}
+	localityID, err := strconv.Atoi(id)
+	matchedID, _ := regexp.MatchString(`^\d+$`, id)
+	if matchedID && err == nil {
+		resp, err := sendRequest(indexKladr, queryByID(localityID))
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		docDates = resultByIDFromHits(resp)
+		for i := range docDates {
+			for j := range docDates[i].Ancestors {
+				docDates[i].Ancestors[j].Type = fullTypeName(docDates[i].Ancestors[j].Type)
+			}
+		}
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Locality ID: ", id, "; Find Result Count: ", len(docDates), "; Time Spent: ", time.Since(start))
+	if len(docDates) == 0 {
+		ctx.Error("not found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(docDates[0])
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+func getLocalityNearby(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var docDates []docDate
+	var center *geoPoint
+	var excludeID int
+	radius := 50.0
+	if len(ctx.QueryArgs().Peek("radius_km")) > 0 {
+		var err error
+		radius, err = strconv.ParseFloat(string(ctx.QueryArgs().Peek("radius_km")), 64)
+		if err != nil || radius <= 0 || radius > 1000 {
+			ctx.Error("radius_km must be between 0 and 1000", fasthttp.StatusBadRequest)
+			return
+		}
+	}
+	id := string(ctx.QueryArgs().Peek("id"))
+	if matchedID, _ := regexp.MatchString(`^\d+$`, id); matchedID {
+		localityID, err := strconv.Atoi(id)
+		if err != nil {
+			ctx.Error("id or lat and lon are required", fasthttp.StatusBadRequest)
+			return
+		}
+		resp, err := sendRequest(indexKladr, queryByID(localityID))
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		origin := resultByIDFromHits(resp)
+		if len(origin) > 0 {
+			center = origin[0].Location
+			excludeID = localityID
+		}
+		if center == nil {
+			log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; No coordinates; Time Spent: ", time.Since(start))
+			ctx.Error("not found", fasthttp.StatusNotFound)
+			return
+		}
 	} else {
-		ctx.Response.Header.Set("Content-Type", "application/json")
-		body, err := json.Marshal(docList)
+		lat, errLat := strconv.ParseFloat(string(ctx.QueryArgs().Peek("lat")), 64)
+		lon, errLon := strconv.ParseFloat(string(ctx.QueryArgs().Peek("lon")), 64)
+		if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			ctx.Error("id or lat and lon are required", fasthttp.StatusBadRequest)
+			return
+		}
+		center = &geoPoint{Lat: lat, Lon: lon}
+	}
+	query := queryNearby(localityTitleFilter(ctx), strconv.FormatFloat(radius, 'f', -1, 64), *center, excludeID, listRowCount)
+	resp, err := sendRequest(indexKladr, query)
+	if err != nil {
+		searchFailed(ctx, err)
+		return
+	}
+	docDates = resultGeoFromHits(resp)
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", len(docDates), "; Time Spent: ", time.Since(start))
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	if len(docDates) > 0 {
+		body, err := json.Marshal(docDates)
 		if err != nil {
 			log.Print(err)
 			sentry.CaptureException(err)
 		}
 		fmt.Fprint(ctx, string(body))
+	} else {
+		fmt.Fprint(ctx, "[]")
 	}
 }
 
-func getGeoIP(ctx *fasthttp.RequestCtx) {
+func getLocalityChildren(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var err error
+	var pageNumber int = 1
+	var childrenList childrenList
+	var queryTypes []string
+	var typeParam string
+	host := string(ctx.Request.Host())
+	scheme := string(ctx.Request.URI().Scheme())
+	realURL := string(ctx.Request.Header.Peek("X-Real-Url"))
+	if len(realURL) == 0 {
+		realURL = scheme + "://" + host + string(ctx.Path())
+	}
+	id := ctx.UserValue("id").(string)
+	parentID, errID := strconv.Atoi(id)
+	matchedID, _ := regexp.MatchString(`^\d+$`, id)
+	matchedID = matchedID && errID == nil
+	if len(string(ctx.QueryArgs().Peek("page"))) > 0 {
+		pageNumber, err = strconv.Atoi(string(ctx.QueryArgs().Peek("page")))
+		if err != nil || pageNumber < 1 {
+			pageNumber = 1
+		}
+	}
+	if len(string(ctx.QueryArgs().Peek("type"))) > 0 {
+		var types []string
+		for _, v := range strings.Split(string(ctx.QueryArgs().Peek("type")), ",") {
+			matchedType, _ := regexp.MatchString(`^[^"\\\s]+$`, v)
+			if matchedType {
+				types = append(types, v)
+			}
+		}
+		if len(types) > 0 {
+			queryTypes = types
+			typeParam = "&type=" + url.QueryEscape(string(ctx.QueryArgs().Peek("type")))
+		} else {
+			matchedID = false
+		}
+	}
+	if matchedID {
+		resp, err := sendRequest(indexKladr, queryChildren(parentID, queryTypes, listRowCount, (pageNumber-1)*listRowCount))
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		childrenList.Result = resultFromHits(resp)
+		childrenList.Count = resp.Hits.Total.Value
+	}
+	if childrenList.Count > 0 {
+		if pageNumber == 2 {
+			childrenList.Previous = realURL + "?page=1" + typeParam
+		} else if pageNumber > 2 {
+			childrenList.Previous = realURL + "?page=" + strconv.Itoa(pageNumber-1) + typeParam
+		}
+		if (listRowCount * pageNumber) < childrenList.Count {
+			childrenList.Next = realURL + "?page=" + strconv.Itoa(pageNumber+1) + typeParam
+		}
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Locality ID: ", id, "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", childrenList.Count, "; Time Spent: ", time.Since(start))
+	if childrenList.Count == 0 || (listRowCount*(pageNumber-1)) >= childrenList.Count {
+		ctx.Error("not found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(childrenList)
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+func getByCode(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var codeDate codeDate
+	var found bool
+	code := ctx.UserValue("code").(string)
+	switch len(code) {
+	case 11, 15:
+		code = code + "00"
+	}
+	matchedCode, _ := regexp.MatchString(`^(\d{13}|\d{17})$`, code)
+	if matchedCode {
+		codeDate.Code = code
+		codeDate.Parts = splitCode(code)
+		if len(code) == 13 {
+			resp, err := sendRequest(indexKladr, queryCode(code))
+			if err != nil {
+				searchFailed(ctx, err)
+				return
+			}
+			docDates := resultFromHits(resp)
+			if len(docDates) > 0 {
+				if docDates[0].Code != code {
+					redirectCode(ctx, docDates[0].Code)
+					return
+				}
+				codeDate.Locality = &docDates[0]
+				found = true
+			}
+		} else {
+			resp, err := sendRequest(indexStreet, queryStrCode(code))
+			if err != nil {
+				searchFailed(ctx, err)
+				return
+			}
+			streetDates := resultStreetFromHits(resp)
+			if len(streetDates) > 0 {
+				if streetDates[0].Code != code {
+					redirectCode(ctx, streetDates[0].Code)
+					return
+				}
+				codeDate.Street = &streetDates[0]
+				found = true
+			}
+		}
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; KLADR Code: ", code, "; Found: ", found, "; Time Spent: ", time.Since(start))
+	if !found {
+		ctx.Error("not found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(codeDate)
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+func redirectCode(ctx *fasthttp.RequestCtx, code string) {
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; KLADR Code: ", ctx.UserValue("code"), "; Redirect To: ", code)
+	ctx.Redirect("/api/kladr/code/"+code, fasthttp.StatusMovedPermanently)
+}
+
+// splitCode decomposes SS RRR GGG PPP AA or SS RRR GGG PPP UUUU AA.
+func splitCode(code string) codeParts {
+	var parts codeParts
+	parts.Region = code[0:2]
+	parts.District = code[2:5]
+	parts.City = code[5:8]
+	parts.Settlement = code[8:11]
+	if len(code) == 17 {
+		parts.Street = code[11:15]
+	}
+	parts.Actuality = code[len(code)-2:]
+	return parts
+}
+
+func getPostcode(ctx *fasthttp.RequestCtx) {
 	start := time.Now()
-	queryValue := string(ctx.QueryArgs().Peek("ip"))
-	matched, _ := regexp.MatchString(`^(\d{1,3}\.){3}\d{1,3}$`, queryValue)
 	var docDates []docDate
-	if matched {
-		ipInt, err := blockToInt(queryValue)
+	index := ctx.UserValue("index").(string)
+	matchedIndex, _ := regexp.MatchString(`^\d{6}$`, index)
+	if matchedIndex {
+		resp, err := sendRequest(indexKladr, queryPostcode(index))
 		if err != nil {
-			fmt.Fprint(ctx, "{}")
+			searchFailed(ctx, err)
 			return
 		}
-		regex := regexp.MustCompile(`"_source"\s*:\s*{[^}]*"city":\s*"([^"]+)"[^}]*}`)
-		res := regex.FindAllStringSubmatch(string(sendGeoRequest(ipInt)), -1)
-		if len(res) == 0 {
-			fmt.Fprint(ctx, "{}")
+		docDates = resultFromHits(resp)
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Postcode: ", index, "; Find Result Count: ", len(docDates), "; Time Spent: ", time.Since(start))
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	if len(docDates) > 0 {
+		body, err := json.Marshal(docDates)
+		if err != nil {
+			log.Print(err)
+			sentry.CaptureException(err)
+		}
+		fmt.Fprint(ctx, string(body))
+	} else {
+		fmt.Fprint(ctx, "[]")
+	}
+}
+
+func getOkato(ctx *fasthttp.RequestCtx) {
+	getClassifier(ctx, "okato")
+}
+
+func getOktmo(ctx *fasthttp.RequestCtx) {
+	getClassifier(ctx, "oktmo")
+}
+
+func getClassifier(ctx *fasthttp.RequestCtx, field string) {
+	start := time.Now()
+	var docDates []docDate
+	var queryFrom int = 0
+	code := ctx.UserValue("code").(string)
+	prefix := string(ctx.QueryArgs().Peek("prefix")) == "1"
+	if len(string(ctx.QueryArgs().Peek("page"))) > 0 {
+		page, err := strconv.Atoi(string(ctx.QueryArgs().Peek("page")))
+		if err == nil && page > 1 {
+			queryFrom = (page - 1) * listRowCount
+		}
+	}
+	matchedCode, _ := regexp.MatchString(`^\d{1,11}$`, code)
+	if matchedCode {
+		resp, err := sendRequest(indexKladr, queryOkato(field, code, prefix, listRowCount, queryFrom))
+		if err != nil {
+			searchFailed(ctx, err)
 			return
 		}
-		city := res[0][1]
-		if len(city) == 0 {
+		docDates = resultFromHits(resp)
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; ", strings.ToUpper(field), ": ", code, "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", len(docDates), "; Time Spent: ", time.Since(start))
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	if len(docDates) > 0 {
+		body, err := json.Marshal(docDates)
+		if err != nil {
+			log.Print(err)
+			sentry.CaptureException(err)
+		}
+		fmt.Fprint(ctx, string(body))
+	} else {
+		fmt.Fprint(ctx, "[]")
+	}
+}
+
+func getGeoIP(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	ip, matched := normalizeIP(string(ctx.QueryArgs().Peek("ip")))
+	if len(ctx.QueryArgs().Peek("ip")) == 0 {
+		ip, matched = clientIP(ctx)
+	}
+	var docDates []docDate
+	if matched {
+		resp, err := sendRequest(indexGeo, queryGeo(ip))
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		if len(resp.Hits.Hits) == 0 {
 			fmt.Fprint(ctx, "{}")
 			return
 		}
-		query := fmt.Sprintf(queryCity, city)
-		biteBody := sendRequest(query)
-		if len(biteBody) > 0 {
-			docDates = resultFromJSON(biteBody)
+		// the importer links every range to one locality, so there is no guessing by city name here
+		kladrID := fastjson.GetInt(resp.Hits.Hits[0].Source, "kladr_id")
+		if kladrID != 0 {
+			resp, err = sendRequest(indexKladr, queryKladrID(kladrID))
+			if err != nil {
+				searchFailed(ctx, err)
+				return
+			}
+			docDates = resultFromHits(resp)
 		}
 	}
 	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", len(docDates), "; Time Spent: ", time.Since(start))
@@ -190,26 +652,145 @@ func getGeoIP(ctx *fasthttp.RequestCtx) {
 	}
 }
 
-func generateQuery(ctx *fasthttp.RequestCtx) string {
-	var queryTerm string
-	var queryRegionString string
-	var queryRegionID string
-	var queryRegionCode string
-	var queryRegionExt string
-	var queryRegionCount int = 0
+func getReverse(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var docDates []docDate
+	lat, errLat := strconv.ParseFloat(string(ctx.QueryArgs().Peek("lat")), 64)
+	lon, errLon := strconv.ParseFloat(string(ctx.QueryArgs().Peek("lon")), 64)
+	if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		ctx.Error("lat and lon are required", fasthttp.StatusBadRequest)
+		return
+	}
+	resp, err := sendRequest(indexKladr, queryReverse(geoPoint{Lat: lat, Lon: lon}))
+	if err != nil {
+		searchFailed(ctx, err)
+		return
+	}
+	docDates = resultGeoFromHits(resp)
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", len(docDates), "; Time Spent: ", time.Since(start))
+	if len(docDates) == 0 {
+		ctx.Error("not found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(docDates[0])
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+func getStreet(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var streetDates []streetDate
+	query, ok := generateStreetQuery(ctx)
+	if ok {
+		resp, err := sendRequest(indexStreet, query)
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		streetDates = resultStreetFromHits(resp)
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Find Result Count: ", len(streetDates), "; Time Spent: ", time.Since(start))
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	if len(streetDates) > 0 {
+		body, err := json.Marshal(streetDates)
+		if err != nil {
+			log.Print(err)
+			sentry.CaptureException(err)
+		}
+		fmt.Fprint(ctx, string(body))
+	} else {
+		fmt.Fprint(ctx, "[]")
+	}
+}
+
+func getHouse(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var houseDate houseDate
+	streetID := string(ctx.QueryArgs().Peek("street_id"))
+	houseDate.House = string(ctx.QueryArgs().Peek("house"))
+	matchedSID, _ := regexp.MatchString(`^\d+$`, streetID)
+	if matchedSID && len(houseDate.House) > 0 {
+		houseDate.StreetID, _ = strconv.Atoi(streetID)
+		resp, err := sendRequest(indexHouse, queryHouse(houseDate.StreetID))
+		if err != nil {
+			searchFailed(ctx, err)
+			return
+		}
+		for _, hit := range resp.Hits.Hits {
+			if matchHouseBlock(fastjson.GetString(hit.Source, "houses"), fastjson.GetString(hit.Source, "korp"), houseDate.House) {
+				houseDate.Found = true
+				houseDate.Postcode = fastjson.GetString(hit.Source, "postcode")
+				houseDate.Okato = fastjson.GetString(hit.Source, "okato")
+				break
+			}
+		}
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Found: ", houseDate.Found, "; Time Spent: ", time.Since(start))
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(houseDate)
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+func latinScheme(ctx *fasthttp.RequestCtx) string {
+	scheme := string(ctx.QueryArgs().Peek("latin"))
+	if scheme == "1" {
+		scheme = "icao"
+	}
+	if _, ok := translitSchemes[scheme]; !ok {
+		return ""
+	}
+	return scheme
+}
+
+func searchTerm(ctx *fasthttp.RequestCtx) string {
+	var termValue string
+	if len(string(ctx.QueryArgs().Peek("search"))) > 0 {
+		termValue = strings.ToLower(string(ctx.QueryArgs().Peek("search")))
+	}
+	if len(string(ctx.QueryArgs().Peek("term"))) == 0 {
+		if len(string(ctx.QueryArgs().Peek("iterm"))) > 0 {
+			termValue = strings.ToLower(string(ctx.QueryArgs().Peek("iterm")))
+		}
+	} else {
+		termValue = strings.ToLower(string(ctx.QueryArgs().Peek("term")))
+	}
+	return termValue
+}
+
+// localityTitleFilter picks the locality types for search, regions_only and cities_and_regions.
+func localityTitleFilter(ctx *fasthttp.RequestCtx) esClause {
+	queryLocalityTitle := esTerms{"locality_title", []string{"г", "п", "с", "х", "д", "нп", "п/ст", "сл", "снт"}}
+	if len(string(ctx.QueryArgs().Peek("search"))) > 0 {
+		queryLocalityTitle = esTerms{"locality_title", []string{"край", "обл", "р-н", "г", "п", "с", "х", "д", "нп", "п/ст", "сл", "снт"}}
+	}
+	if string(ctx.QueryArgs().Peek("regions_only")) == "1" {
+		queryLocalityTitle = esTerms{"region_code", []int{0}}
+	}
+	if string(ctx.QueryArgs().Peek("cities_and_regions")) == "1" {
+		queryLocalityTitle = esTerms{"locality_title", []string{"край", "обл", "г"}}
+	}
+	return queryLocalityTitle
+}
+
+func generateQuery(ctx *fasthttp.RequestCtx, termValue string) (esSearch, bool) {
+	var queryTerm []esClause
+	var queryRegionList []esClause
 	var querySize int = rowCount
 	var queryFrom int = 0
-	var queryLocalityTitle string = `"locality_title":["г","п","с","х","д","нп","п/ст","сл","снт"]`
-	var queryFilters string = `,"functions":[{"filter":{"term":{"locality_title":"г"}},"weight":200},{"filter":{"term":{"locality_title":"п"}},"weight":100}]`
-	var termValue string
+	var queryFilters = []esFunction{{esTerm{"locality_title", "г"}, 200}, {esTerm{"locality_title", "п"}, 100}}
 	var termExt string
 	var emptyResult bool = false
-	var query string
 	if len(string(ctx.QueryArgs().Peek("search"))) > 0 {
-		termValue = strings.ToLower(string(ctx.QueryArgs().Peek("search")))
 		//termExt = `*`
-		queryLocalityTitle = `"locality_title":["край","обл","р-н","г","п","с","х","д","нп","п/ст","сл","снт"]`
-		queryFilters = `,"functions":[{"filter":{"term":{"locality_title":"г"}},"weight":200},{"filter":{"term":{"locality_title":"край"}},"weight":170},{"filter":{"term":{"locality_title":"обл"}},"weight":170},{"filter":{"term":{"locality_title":"р-н"}},"weight":170},{"filter":{"term":{"locality_title":"п"}},"weight":100}]`
+		queryFilters = []esFunction{{esTerm{"locality_title", "г"}, 200}, {esTerm{"locality_title", "край"}, 170}, {esTerm{"locality_title", "обл"}, 170}, {esTerm{"locality_title", "р-н"}, 170}, {esTerm{"locality_title", "п"}, 100}}
 		querySize = listRowCount
 	}
 	if len(string(ctx.QueryArgs().Peek("page"))) > 0 {
@@ -221,17 +802,129 @@ func generateQuery(ctx *fasthttp.RequestCtx) string {
 			}
 		}
 	}
-	if len(string(ctx.QueryArgs().Peek("regions_only"))) > 0 {
-		if string(ctx.QueryArgs().Peek("regions_only")) == "1" {
-			queryLocalityTitle = `"region_code":[0]`
+	if string(ctx.QueryArgs().Peek("cities_and_regions")) == "1" {
+		queryFilters = nil
+	}
+	if len(string(ctx.QueryArgs().Peek("term"))) == 0 && len(string(ctx.QueryArgs().Peek("iterm"))) > 0 {
+		termExt = `*`
+	}
+	variants := translitVariants(termValue)
+	if len(variants) == 0 {
+		queryTerm = termClause(termValue, termExt)
+	} else {
+		var queryVariants []esClause
+		for _, v := range append([]string{termValue}, variants...) {
+			queryVariants = append(queryVariants, esBool{Must: termClause(v, termExt)})
 		}
+		queryTerm = []esClause{esBool{Should: queryVariants}}
 	}
-	if len(string(ctx.QueryArgs().Peek("cities_and_regions"))) > 0 {
-		if string(ctx.QueryArgs().Peek("cities_and_regions")) == "1" {
-			queryLocalityTitle = `"locality_title":["край","обл","г"]`
-			queryFilters = ``
+	if string(ctx.QueryArgs().Peek("fuzzy")) == "1" && len(termValue) > 0 {
+		queryStrict := esBool{Name: "strict", Must: queryTerm}
+		queryFuzzy := esMatch{Field: "locality_name", Query: termValue, Fuzziness: "AUTO", PrefixLength: 1, Operator: "and"}
+		queryTerm = []esClause{esBool{Should: []esClause{queryStrict, queryFuzzy}}}
+		queryFilters = append([]esFunction{{queryStrict, 1000}}, queryFilters...)
+	}
+	matchedRID, _ := regexp.MatchString(`^\d+$`, string(ctx.QueryArgs().Peek("region_id")))
+	regionID, errRID := strconv.Atoi(string(ctx.QueryArgs().Peek("region_id")))
+	if matchedRID && errRID == nil {
+		queryRegionList = append(queryRegionList, esTerm{"region_id", regionID})
+	} else if len(ctx.QueryArgs().Peek("region_id")) != 0 {
+		emptyResult = true
+	}
+	matchedRCD, _ := regexp.MatchString(`^\d+$`, string(ctx.QueryArgs().Peek("region_code")))
+	regionCode, errRCD := strconv.Atoi(string(ctx.QueryArgs().Peek("region_code")))
+	if matchedRCD && errRCD == nil {
+		queryRegionList = append(queryRegionList, esTerm{"region_code", regionCode})
+	} else if len(ctx.QueryArgs().Peek("region_code")) != 0 {
+		emptyResult = true
+	}
+	matchedPostcode, _ := regexp.MatchString(`^\d{6}$`, string(ctx.QueryArgs().Peek("postcode")))
+	if matchedPostcode {
+		queryRegionList = append(queryRegionList, esTerm{"postcode", string(ctx.QueryArgs().Peek("postcode"))})
+	} else if len(ctx.QueryArgs().Peek("postcode")) != 0 {
+		emptyResult = true
+	}
+	for _, field := range []string{"okato", "oktmo"} {
+		code := string(ctx.QueryArgs().Peek(field))
+		matchedCode, _ := regexp.MatchString(`^\d{1,11}$`, code)
+		if matchedCode {
+			queryRegionList = append(queryRegionList, esPrefix{field, code})
+		} else if len(code) != 0 {
+			emptyResult = true
 		}
 	}
+	if emptyResult {
+		return esSearch{}, false
+	}
+	query := esBool{Must: append(queryTerm, localityTitleFilter(ctx))}
+	if len(queryRegionList) > 0 {
+		query.Filter = []esClause{esBool{Must: queryRegionList}}
+	}
+	return esSearch{
+		Query:  esFunctionScore{Query: query, Functions: queryFilters, BoostMode: "replace"},
+		Sort:   []interface{}{"_score", esSortField{"status", "desc"}},
+		Source: excludeAncestors,
+		Size:   querySize,
+		From:   queryFrom,
+	}, true
+}
+
+// strictFound reports whether the search matched without typo tolerance, fuzzy hits are not marked by the "strict" named query.
+func strictFound(ctx *fasthttp.RequestCtx, resp searchResponse, count int) bool {
+	if count == 0 {
+		return false
+	}
+	if string(ctx.QueryArgs().Peek("fuzzy")) != "1" {
+		return true
+	}
+	return resp.matched("strict")
+}
+
+func getSuggestion(termValue string) string {
+	if len(termValue) == 0 {
+		return ""
+	}
+	resp, err := sendRequest(indexKladr, querySuggest(termValue))
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+		return ""
+	}
+	var words []string
+	changed := false
+	for _, entry := range resp.Suggest["name"] {
+		word := entry.Text
+		if len(entry.Options) > 0 {
+			word = entry.Options[0].Text
+			changed = true
+		}
+		words = append(words, word)
+	}
+	if !changed {
+		return ""
+	}
+	return strings.Join(words, " ")
+}
+
+func termClause(termValue string, termExt string) []esClause {
+	rxp := regexp.MustCompile(`^([^\!\?\\\,\.\/\(\)]+)\s+([^\!\?\\\,\.\/\(\)]+)$`)
+	rxpGroup := rxp.FindStringSubmatch(termValue)
+	if len(rxpGroup) == 3 {
+		return []esClause{esWildcard{"locality_name", escapeWildcard(rxpGroup[1]) + "*"}, esWildcard{"locality_name", "*" + escapeWildcard(rxpGroup[2]) + "*"}}
+	}
+	termValue = strings.Replace(termValue, " ", "", -1)
+	return []esClause{esWildcard{"locality_name", termExt + escapeWildcard(termValue) + "*"}}
+}
+
+func generateStreetQuery(ctx *fasthttp.RequestCtx) (esSearch, bool) {
+	var termValue string
+	var termExt string
+	var queryTerm []esClause
+	matchedLID, _ := regexp.MatchString(`^\d+$`, string(ctx.QueryArgs().Peek("locality_id")))
+	localityID, err := strconv.Atoi(string(ctx.QueryArgs().Peek("locality_id")))
+	if !matchedLID || err != nil {
+		return esSearch{}, false
+	}
 	if len(string(ctx.QueryArgs().Peek("term"))) == 0 {
 		if len(string(ctx.QueryArgs().Peek("iterm"))) > 0 {
 			termValue = strings.ToLower(string(ctx.QueryArgs().Peek("iterm")))
@@ -240,124 +933,148 @@ func generateQuery(ctx *fasthttp.RequestCtx) string {
 	} else {
 		termValue = strings.ToLower(string(ctx.QueryArgs().Peek("term")))
 	}
-	matchedTerm, _ := regexp.MatchString(`^[^\!\?\\\,\.\/\(\)\s]+$`, termValue)
+	termValue = strings.Replace(termValue, " ", "", -1)
+	matchedTerm, _ := regexp.MatchString(`^[^\!\?\\\,\.\/\(\)\s"]+$`, termValue)
 	if matchedTerm {
-		queryTerm = `{"wildcard":{"locality_name":"` + termExt + termValue + `*"}},`
+		queryTerm = []esClause{esWildcard{"street_name", termExt + escapeWildcard(termValue) + "*"}}
+	} else if len(termValue) > 0 {
+		return esSearch{}, false
 	}
-	rxp := regexp.MustCompile(`^([^\!\?\\\,\.\/\(\)]+)\s+([^\!\?\\\,\.\/\(\)]+)$`)
-	rxpGroup := rxp.FindStringSubmatch(termValue)
-	if len(rxpGroup) == 3 {
-		queryTerm = `{"wildcard":{"locality_name":"` + rxpGroup[1] + `*"}},{"wildcard":{"locality_name":"*` + rxpGroup[2] + `*"}},`
-	} else {
-		termValue = strings.Replace(termValue, " ", "", -1)
-		queryTerm = `{"wildcard":{"locality_name":"` + termExt + termValue + `*"}},`
-	}
-	matchedRID, _ := regexp.MatchString(`^\d+$`, string(ctx.QueryArgs().Peek("region_id")))
-	if matchedRID {
-		queryRegionID = `{"term":{"region_id":` + string(ctx.QueryArgs().Peek("region_id")) + `}}`
-		queryRegionCount++
-	} else if len(ctx.QueryArgs().Peek("region_id")) != 0 {
-		emptyResult = true
-	}
-	matchedRCD, _ := regexp.MatchString(`^\d+$`, string(ctx.QueryArgs().Peek("region_code")))
-	if matchedRCD {
-		queryRegionCode = `{"term":{"region_code":` + string(ctx.QueryArgs().Peek("region_code")) + `}}`
-		queryRegionCount++
-	} else if len(ctx.QueryArgs().Peek("region_code")) != 0 {
-		emptyResult = true
+	return queryStreet(queryTerm, localityID, rowCount), true
+}
+
+// sendRequest runs the query against one of indexKladr, indexStreet, indexHouse or indexGeo.
+func sendRequest(index string, query esSearch) (searchResponse, error) {
+	return searcher.Search(index, query)
+}
+
+// searchFailed answers 502 instead of an empty result when the search fails or returns a partial one,
+// and 400 when the query can't be built from the request.
+func searchFailed(ctx *fasthttp.RequestCtx, err error) {
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; ", err)
+	if _, ok := err.(queryError); ok {
+		ctx.Error("bad request", fasthttp.StatusBadRequest)
+		return
 	}
-	if queryRegionCount == 2 {
-		queryRegionExt = `,`
+	sentry.CaptureException(err)
+	ctx.Error("search failed", fasthttp.StatusBadGateway)
+}
+
+func resultFromHits(resp searchResponse) []docDate {
+	var docDates []docDate
+	for _, hit := range resp.Hits.Hits {
+		docDates = append(docDates, docDateFromSource(hit.Source))
 	}
-	if queryRegionCount > 0 {
-		queryRegionString = `,"filter":{"bool":{"must":[` + queryRegionID + queryRegionExt + queryRegionCode + `]}}`
+	return docDates
+}
+
+func resultByIDFromHits(resp searchResponse) []docDate {
+	var docDates []docDate
+	for _, hit := range resp.Hits.Hits {
+		docDate := docDateFromSource(hit.Source)
+		source, err := fastjson.ParseBytes(hit.Source)
+		if err != nil {
+			log.Print(err)
+			sentry.CaptureException(err)
+			continue
+		}
+		for _, v := range source.GetArray("ancestors") {
+			var ancestor ancestor
+			ancestor.ID = v.GetInt("id")
+			ancestor.Name = string(v.GetStringBytes("name"))
+			ancestor.Type = string(v.GetStringBytes("type"))
+			ancestor.Status = v.GetInt("status")
+			docDate.Ancestors = append(docDate.Ancestors, ancestor)
+		}
+		docDates = append(docDates, docDate)
 	}
-	if !emptyResult {
-		queryCount := `"size":` + strconv.Itoa(querySize) + `,"from":` + strconv.Itoa(queryFrom)
-		query = fmt.Sprintf(querySingle, queryTerm, queryLocalityTitle, queryRegionString, queryFilters, queryCount)
+	return docDates
+}
+
+func docDateFromSource(jsonBody []byte) docDate {
+	var docDate docDate
+	docDate.ID = fastjson.GetInt(jsonBody, "doc_id")
+	docDate.Code = fastjson.GetString(jsonBody, "code")
+	docDate.Postcode = fastjson.GetString(jsonBody, "postcode")
+	docDate.Okato = fastjson.GetString(jsonBody, "okato")
+	docDate.Oktmo = fastjson.GetString(jsonBody, "oktmo")
+	docDate.Status = fastjson.GetInt(jsonBody, "status")
+	docDate.FullName = replaceFullName(fastjson.GetString(jsonBody, "full_name"))
+	docDate.LocalityType.LocalityTitle = fullTypeName(fastjson.GetString(jsonBody, "locality_title"))
+	docDate.LocalityType.LocalityName = fastjson.GetString(jsonBody, "locality_name")
+	docDate.Location = geoPointFromString(fastjson.GetString(jsonBody, "location"))
+	if fastjson.GetInt(jsonBody, "region_id") != 0 {
+		var docDateRegion region
+		docDateRegion.RegionTitle = fastjson.GetString(jsonBody, "region_title")
+		docDateRegion.RegionCode = fastjson.GetInt(jsonBody, "region_code")
+		docDateRegion.RegionID = fastjson.GetInt(jsonBody, "region_id")
+		docDate.Region = docDateRegion
+	} else {
+		docDate.Region = nil
 	}
-	return query
+	return docDate
 }
 
-func sendRequest(query string) []byte {
-	req := fasthttp.AcquireRequest()
-	req.SetRequestURI(elasticURL + "/_search")
-	req.Header.SetContentType("application/json")
-	req.Header.SetConnectionClose()
-	req.Header.SetMethod("POST")
-	req.SetBodyString(query)
-	resp := fasthttp.AcquireResponse()
-	client := &fasthttp.Client{}
-	client.Do(req, resp)
-	if resp.StatusCode() != fasthttp.StatusOK {
-		log.Print("Elastic Response Error:", string(resp.Body()))
-		return []byte(``)
+// geoPointFromString reads the "lat,lon" form the OSM importer stores in the location field.
+func geoPointFromString(a string) *geoPoint {
+	parts := strings.Split(a, ",")
+	if len(parts) != 2 {
+		return nil
 	}
-	return resp.Body()
+	lat, errLat := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, errLon := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errLat != nil || errLon != nil {
+		return nil
+	}
+	return &geoPoint{Lat: lat, Lon: lon}
 }
 
-func resultFromJSON(body []byte) []docDate {
-	regex := regexp.MustCompile(`"_source"\s*:\s*({[^}]*})`)
-	res := regex.FindAllStringSubmatch(string(body), -1)
+// resultGeoFromHits takes the distance from the _geo_distance sort value of every hit.
+func resultGeoFromHits(resp searchResponse) []docDate {
 	var docDates []docDate
-	var docDate docDate
-	if len(res) > 0 {
-		var jsonBody []byte
-		i := 0
-		for {
-			if i == len(res) {
-				break
+	for _, hit := range resp.Hits.Hits {
+		docDate := docDateFromSource(hit.Source)
+		if len(hit.Sort) > 0 {
+			if sort, ok := hit.Sort[0].(float64); ok {
+				distance := float64(int(sort*100+0.5)) / 100
+				docDate.Distance = &distance
 			}
-			jsonBody = []byte(res[i][1])
-			docDate.ID = fastjson.GetInt(jsonBody, "doc_id")
-			docDate.Status = fastjson.GetInt(jsonBody, "status")
-			docDate.FullName = replaceFullName(fastjson.GetString(jsonBody, "full_name"))
-			docDate.LocalityType.LocalityTitle = getReplace(fastjson.GetString(jsonBody, "locality_title"))
-			docDate.LocalityType.LocalityName = fastjson.GetString(jsonBody, "locality_name")
-			if fastjson.GetInt(jsonBody, "region_id") != 0 {
-				var docDateRegion region
-				docDateRegion.RegionTitle = fastjson.GetString(jsonBody, "region_title")
-				docDateRegion.RegionCode = fastjson.GetInt(jsonBody, "region_code")
-				docDateRegion.RegionID = fastjson.GetInt(jsonBody, "region_id")
-				docDate.Region = docDateRegion
-			} else {
-				docDate.Region = nil
-			}
-			docDates = append(docDates, docDate)
-			i++
 		}
+		docDates = append(docDates, docDate)
 	}
 	return docDates
 }
 
-func resultListFromJSON(body []byte) ([]localityList, int) {
-	var count int = 0
+func resultListFromHits(resp searchResponse) ([]localityList, int) {
 	var locList []localityList
 	var locData localityList
-	rxCount := regexp.MustCompile(`"hits"\s*:\s*{\s*"total"\s*:\s*{\s*"value"\s*:\s*(\d+)`)
-	resCount := rxCount.FindAllStringSubmatch(string(body), -1)
-	if len(resCount) > 0 {
-		count, _ = strconv.Atoi(resCount[0][1])
-	}
-	if count > 0 {
-		regex := regexp.MustCompile(`"_source"\s*:\s*({[^}]*})`)
-		res := regex.FindAllStringSubmatch(string(body), -1)
-		if len(res) > 0 {
-			var jsonBody []byte
-			i := 0
-			for {
-				if i == len(res) {
-					break
-				}
-				jsonBody = []byte(res[i][1])
-				locData.ID = fastjson.GetInt(jsonBody, "doc_id")
-				locData.Text = fastjson.GetString(jsonBody, "locality_name") + " " + getReplace(fastjson.GetString(jsonBody, "locality_title"))
-				locList = append(locList, locData)
-				i++
-			}
+	for _, hit := range resp.Hits.Hits {
+		locData.ID = fastjson.GetInt(hit.Source, "doc_id")
+		locData.Text = fastjson.GetString(hit.Source, "locality_name") + " " + fullTypeName(fastjson.GetString(hit.Source, "locality_title"))
+		locList = append(locList, locData)
+	}
+	return locList, resp.Hits.Total.Value
+}
+
+func resultStreetFromHits(resp searchResponse) []streetDate {
+	var streetDates []streetDate
+	for _, hit := range resp.Hits.Hits {
+		var streetDate streetDate
+		jsonBody := []byte(hit.Source)
+		streetDate.ID = fastjson.GetInt(jsonBody, "doc_id")
+		streetDate.Code = fastjson.GetString(jsonBody, "code")
+		streetDate.FullName = fastjson.GetString(jsonBody, "full_name")
+		streetDate.StreetType.LocalityTitle = getStreetReplace(fastjson.GetString(jsonBody, "street_title"))
+		streetDate.StreetType.LocalityName = fastjson.GetString(jsonBody, "street_name")
+		if fastjson.GetInt(jsonBody, "locality_id") != 0 {
+			var locality streetLocality
+			locality.LocalityID = fastjson.GetInt(jsonBody, "locality_id")
+			locality.LocalityTitle = replaceFullName(fastjson.GetString(jsonBody, "locality_title"))
+			streetDate.Locality = locality
 		}
+		streetDates = append(streetDates, streetDate)
 	}
-	return locList, count
+	return streetDates
 }
 
 func replaceFullName(a string) string {
@@ -368,54 +1085,152 @@ func replaceFullName(a string) string {
 	return a
 }
 
-func sendGeoRequest(addr int64) []byte {
-	req := fasthttp.AcquireRequest()
-	req.SetRequestURI(elasticGeoURL + "/_search")
-	req.Header.SetContentType("application/json")
-	req.Header.SetConnectionClose()
-	req.Header.SetMethod("POST")
-	query := fmt.Sprintf(queryGeo, addr, addr)
-	req.SetBodyString(query)
-	resp := fasthttp.AcquireResponse()
-	client := &fasthttp.Client{}
-	client.Do(req, resp)
-	if resp.StatusCode() != fasthttp.StatusOK {
-		log.Print("Elastic Response Error:", string(resp.Body()))
-		return []byte(``)
+// clientIP takes the caller address from the connection, proxy headers are read only when the
+// connection comes from TRUSTED_PROXIES. The chain is walked from the right, so the first address
+// not owned by a trusted proxy wins and a client can't spoof its address with its own header.
+func clientIP(ctx *fasthttp.RequestCtx) (string, bool) {
+	remote := ctx.RemoteIP()
+	if !isTrustedProxy(remote) {
+		return normalizeIP(remote.String())
 	}
-	return resp.Body()
+	var chain []string
+	if forwarded := string(ctx.Request.Header.Peek("Forwarded")); len(forwarded) > 0 {
+		for _, element := range strings.Split(forwarded, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					chain = append(chain, forwardedAddr(pair[4:]))
+				}
+			}
+		}
+	} else if forwardedFor := string(ctx.Request.Header.Peek("X-Forwarded-For")); len(forwardedFor) > 0 {
+		chain = strings.Split(forwardedFor, ",")
+	} else if realIP := string(ctx.Request.Header.Peek("X-Real-IP")); len(realIP) > 0 {
+		chain = []string{realIP}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, ok := normalizeIP(chain[i])
+		if !ok {
+			break
+		}
+		if i == 0 || !isTrustedProxy(net.ParseIP(ip)) {
+			return ip, true
+		}
+	}
+	return normalizeIP(remote.String())
 }
 
-func blockToInt(addr string) (int64, error) {
-	var ipInt int64
-	r := regexp.MustCompile(`^(\d{1,3})\.(\d{1,3})\.(\d{1,3})\.(\d{1,3})$`)
-	start := r.FindStringSubmatch(addr)
-	start = append(start[:0], start[1:]...)
-	startRes := "1"
-	for _, v := range start {
-		startRes = startRes + toThreeChar(v)
+// forwardedAddr strips quotes and the port from a Forwarded for= value: "[2001:db8::1]:4711", 192.0.2.60:80.
+func forwardedAddr(a string) string {
+	a = strings.Trim(strings.TrimSpace(a), `"`)
+	if strings.HasPrefix(a, "[") {
+		if end := strings.Index(a, "]"); end > 0 {
+			return a[1:end]
+		}
 	}
-	ipInt, err := strconv.ParseInt(startRes, 10, 64)
-	return ipInt, err
+	if strings.Count(a, ":") == 1 {
+		return a[:strings.Index(a, ":")]
+	}
+	return a
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, v := range trustedNets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeIP accepts IPv4 and IPv6 addresses, IPv4-mapped IPv6 is written as plain IPv4.
+func normalizeIP(addr string) (string, bool) {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String(), true
+	}
+	return ip.String(), true
+}
+
+var (
+	latinLayout    = []rune("qwertyuiop[]asdfghjkl;'zxcvbnm,.`")
+	cyrillicLayout = []rune("йцукенгшщзхъфывапролджэячсмитьбюё")
+)
+
+// swapLayout retypes a term as if it was typed with the other keyboard layout: "vjcrdf" <-> "москва".
+func swapLayout(a string) (string, bool) {
+	var sb strings.Builder
+	changed := false
+	for _, r := range a {
+		swapped := r
+		for i := range latinLayout {
+			if r == latinLayout[i] {
+				swapped = cyrillicLayout[i]
+				break
+			} else if r == cyrillicLayout[i] {
+				swapped = latinLayout[i]
+				break
+			}
+		}
+		if swapped != r {
+			changed = true
+		}
+		sb.WriteRune(swapped)
+	}
+	return sb.String(), changed
+}
+
+// isLatinLayout reports a term typed only with Latin layout keys, names in the index are Cyrillic.
+func isLatinLayout(a string) bool {
+	matched, _ := regexp.MatchString("^[a-z\\[\\];',.`\\s-]+$", a)
+	return matched
 }
 
-func toThreeChar(val string) string {
-	var result string
-	switch a := len(val); a {
-	case 1:
-		result = "00" + val
-	case 2:
-		result = "0" + val
-	default:
-		result = val
+// localityTypes pairs KLADR abbreviations of localities with their full names.
+var localityTypes = []string{"Респ", "республика", "обл", "область", "АО", "автономный округ", "г", "город", "п", "поселок", "с", "село", "х", "хутор", "д", "деревня", "нп", "населенный пункт", "п/ст", "поселок при станции", "сл", "слобода", "снт", "садовое некоммерческое товарищество"}
+
+// fullTypeName gives the full name of a whole abbreviation by typeNames and streetTypes ("р-н" is
+// "район", "пгт" is "поселок городского типа"), an unknown one is returned as it is.
+func fullTypeName(abbr string) string {
+	if name, ok := typeNames[abbr]; ok {
+		return name
+	}
+	if name, ok := streetTypes[abbr]; ok {
+		return name
 	}
-	return result
+	return abbr
 }
 
-func getReplace(a string) string {
-	replacer := strings.NewReplacer("Респ", "республика", "обл", "область", "АО", "автономный округ", "г", "город", "п", "поселок", "с", "село", "х", "хутор", "д", "деревня", "нп", "населенный пункт", "п/ст", "поселок при станции", "сл", "слобода", "снт", "садовое некоммерческое товарищество")
-	b := replacer.Replace(a)
-	return b
+var streetTypes = map[string]string{
+	"ул":     "улица",
+	"пр-кт":  "проспект",
+	"пер":    "переулок",
+	"б-р":    "бульвар",
+	"ш":      "шоссе",
+	"пл":     "площадь",
+	"проезд": "проезд",
+	"наб":    "набережная",
+	"туп":    "тупик",
+	"мкр":    "микрорайон",
+	"кв-л":   "квартал",
+	"тер":    "территория",
+	"аллея":  "аллея",
+	"линия":  "линия",
+	"тракт":  "тракт",
+	"дор":    "дорога",
+	"сквер":  "сквер",
+	"спуск":  "спуск",
+	"км":     "километр",
+}
+
+func getStreetReplace(a string) string {
+	if b, ok := streetTypes[a]; ok {
+		return b
+	}
+	return a
 }
 
 func getStatus(ctx *fasthttp.RequestCtx) {
@@ -424,27 +1239,13 @@ func getStatus(ctx *fasthttp.RequestCtx) {
 }
 
 func getVersion(ctx *fasthttp.RequestCtx) {
-	var respError string
-	req := fasthttp.AcquireRequest()
-	req.SetRequestURI(elasticURL)
-	req.Header.SetConnectionClose()
-	req.Header.SetMethod("GET")
-	resp := fasthttp.AcquireResponse()
-	client := &fasthttp.Client{MaxIdleConnDuration: time.Second}
-	client.Do(req, resp)
 	ctx.Response.Header.Set("Content-Type", "application/json")
-	if resp.Header.ContentLength() == 0 {
-		respError = "No connection to Elastic"
-	}
-	if resp.StatusCode() == fasthttp.StatusNotFound {
-		respError = "Elastic Index KLADR not available"
-	}
-	if resp.StatusCode() == fasthttp.StatusOK && resp.Header.ContentLength() > 0 {
-		fmt.Fprint(ctx, `{"data": {"version": "`+branch+`"}, "error": {`+respError+`}}`)
-	} else {
-		sentry.CaptureException(errors.New(respError))
-		ctx.Error(respError, fasthttp.StatusInternalServerError)
+	if err := searcher.Ping(); err != nil {
+		sentry.CaptureException(err)
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
 	}
+	fmt.Fprint(ctx, `{"data": {"version": "`+branch+`"}, "error": {}}`)
 }
 
 func main() {
@@ -460,20 +1261,81 @@ func main() {
 	if len(os.Getenv("ELASTIC")) > 0 {
 		elasticGeoURL = os.Getenv("ELASTIC")
 	}
+	elasticStrURL = `http://localhost:9200/street`
+	if len(os.Getenv("ELASTIC_STREET")) > 0 {
+		elasticStrURL = os.Getenv("ELASTIC_STREET")
+	}
+	elasticHseURL = `http://localhost:9200/house`
+	if len(os.Getenv("ELASTIC_HOUSE")) > 0 {
+		elasticHseURL = os.Getenv("ELASTIC_HOUSE")
+	}
+	searcher = elasticSearcher{urls: map[string]string{indexKladr: elasticURL, indexStreet: elasticStrURL, indexHouse: elasticHseURL, indexGeo: elasticGeoURL}}
+	if os.Getenv("SEARCH_BACKEND") == "memory" {
+		if len(os.Getenv("DUMP_KLADR")) == 0 {
+			log.Panic("Env variable DUMP_KLADR is null\nExample: /data/kladr.jsonl")
+		}
+		memory, err := newMemorySearcher(map[string]string{
+			indexKladr:  os.Getenv("DUMP_KLADR"),
+			indexStreet: os.Getenv("DUMP_STREET"),
+			indexHouse:  os.Getenv("DUMP_HOUSE"),
+			indexGeo:    os.Getenv("DUMP_GEO"),
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		for index, v := range memory.indices {
+			log.Print("Index ", index, " loaded: ", v.docs.Len(), " documents")
+		}
+		searcher = memory
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve := flag.NewFlagSet("serve", flag.ExitOnError)
+		snapshotPath := serve.String("snapshot", "", "index file built by the importers, answers without Elasticsearch\nExample: /data/kladr.idx")
+		serve.Parse(os.Args[2:])
+		if len(*snapshotPath) > 0 {
+			file, err := snapshot.Open(*snapshotPath)
+			if err != nil {
+				log.Panic(err)
+			}
+			if file.Index(indexKladr) == nil {
+				log.Panic("Snapshot has no index kladr: ", *snapshotPath)
+			}
+			memory := newSnapshotSearcher(file)
+			for index, v := range memory.indices {
+				log.Print("Index ", index, " mapped: ", v.docs.Len(), " documents")
+			}
+			searcher = memory
+		}
+	}
 	err := sentry.Init(sentry.ClientOptions{
 		Dsn: os.Getenv("SENTRYURL"),
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v = v + "/128"
+			} else {
+				v = v + "/32"
+			}
+		}
+		_, proxy, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Panic("Env TRUSTED_PROXIES must be a comma separated list of CIDR: ", err)
+		}
+		trustedNets = append(trustedNets, proxy)
+	}
 	if len(os.Getenv("BRANCH")) > 0 {
 		branch = os.Getenv("BRANCH")
 	}
 	rowCount = 15
 	listRowCount = 30
-	querySingle = `{"query":{"function_score":{"boost_mode":"replace","query": {"bool":{"must":[` + "%s" + `{"terms":{` + "%s" + `}}]` + "%s" + `}}` + "%s" + `}},"sort":["_score",{"status":{"order":"desc"}}],` + "%s" + `}`
-	queryCity = `{"query":{"function_score":{"boost_mode":"replace","query":{"bool":{"must":[{"match":{"locality_name":"` + "%s" + `"}},{"terms":{"locality_title":["г","п","с","х","д","нп","п/ст","сл","снт"]}}]}},"functions":[{"filter":{"term":{"locality_title":"г"}},"weight":200},{"filter":{"term":{"locality_title":"п"}},"weight":100}]}},"sort":["_score",{"status":{"order":"desc"}}],"size":1,"from":0}`
-	queryGeo = `{"query":{"bool":{"must":[{"match":{"country":"RU"}},{"range":{"start_ip":{"lte":` + "%d" + `}}},{"range":{"end_ip":{"gte":` + "%d" + `}}}]}},"size":1,"from":0}`
 	addCORS := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowCredentials: true,
@@ -484,10 +1346,27 @@ func main() {
 	router.GET("/locality/", getLocality)
 	router.GET("/api/locality", getLocality)
 	router.GET("/api/locality/", getLocality)
+	router.GET("/api/locality/:id", getLocalityByID)
+	router.GET("/api/locality/:id/children", getLocalityChildren)
+	router.GET("/api/locality/:id/children/", getLocalityChildren)
+	router.GET("/api/kladr/code/:code", getByCode)
 	router.GET("/api/kladr/for_select", getLocalityList)
 	router.GET("/api/kladr/for_select/", getLocalityList)
+	router.GET("/api/postcode/:index", getPostcode)
+	router.GET("/api/okato/:code", getOkato)
+	router.GET("/api/oktmo/:code", getOktmo)
 	router.GET("/api/geoip", getGeoIP)
 	router.GET("/api/geoip/", getGeoIP)
+	router.GET("/api/reverse", getReverse)
+	router.GET("/api/reverse/", getReverse)
+	router.GET("/api/street", getStreet)
+	router.GET("/api/street/", getStreet)
+	router.GET("/api/house", getHouse)
+	router.GET("/api/house/", getHouse)
+	router.POST("/api/address/parse", postAddressParse)
+	router.POST("/api/address/parse/", postAddressParse)
+	router.GET("/api/address/standard", getAddressStandard)
+	router.GET("/api/address/standard/", getAddressStandard)
 	router.GET("/status", getStatus)
 	router.GET("/api/system/version", getVersion)
 	server := &fasthttp.Server{
@@ -0,0 +1,345 @@
+// Package snapshot reads and writes the compact index file served by "kladr serve --snapshot".
+//
+// The file is a table of named sections followed by their data, every index stored in it has:
+//
+//	<index>/docs, <index>/docs.off          _source of the documents and their offsets
+//	<index>/num/<field>                     float64 column, NaN when the document has no value
+//	<index>/str/<field>, .off               string column, "" when missing, else "\x01" and the values joined by "\x00"
+//	<index>/terms/<field>, .off             sorted tokens of a text field
+//	<index>/post/<field>, .off              postings: positions of the documents with the token (uint32)
+//
+// All numbers are little endian, offsets are uint64 with one more entry than values. The file
+// is mapped into memory, sources and columns are read from it without copying.
+//
+// Term dictionaries are sorted token arrays searched by binary search rather than an FST: a
+// prefix or wildcard lookup is a range of the array, the biggest dictionary (locality_name) is a
+// few MB, and a stdlib-only reader stays short. An FST would save that space at the cost of a
+// hand-written builder and traversal.
+package snapshot
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const magic = "KLADRIDX"
+const version = 1
+
+// TextFields are analyzed by the standard analyzer in the index mappings and get term
+// dictionaries, other strings are keywords.
+var TextFields = map[string]bool{"full_name": true, "locality_title": true, "locality_name": true, "region_title": true, "alt_names": true, "street_title": true, "street_name": true, "city": true, "region": true, "district": true, "country": true}
+
+// KeyFields are keywords and numbers looked up by term often enough to get term dictionaries,
+// their values are stored as they are.
+var KeyFields = map[string]bool{"doc_id": true, "parent_id": true, "code": true, "alt_codes": true, "postcode": true, "locality_id": true, "street_id": true}
+
+// Analyze splits like the standard analyzer: lower case, letters and digits only.
+func Analyze(a string) []string {
+	return strings.FieldsFunc(strings.ToLower(a), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type Snapshot struct {
+	data     []byte
+	sections map[string][]byte
+	unmap    func() error
+}
+
+type Index struct {
+	docs    []byte
+	docsOff []byte
+	num     map[string][]byte
+	str     map[string][2][]byte
+	terms   map[string]*Terms
+}
+
+type Terms struct {
+	tokens    []byte
+	tokensOff []byte
+	post      []byte
+	postOff   []byte
+}
+
+func Open(path string) (*Snapshot, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := readSections(data)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	snapshot := &Snapshot{data: data, sections: sections, unmap: unmap}
+	// the readers trust the offsets, a truncated or broken file is rejected here instead of
+	// panicking in a search
+	for _, name := range snapshot.Indices() {
+		if err := snapshot.Index(name).check(); err != nil {
+			unmap()
+			return nil, errors.New("Broken snapshot index " + name + ": " + err.Error())
+		}
+	}
+	return snapshot, nil
+}
+
+func (snapshot *Snapshot) Close() error {
+	return snapshot.unmap()
+}
+
+func readSections(data []byte) (map[string][]byte, error) {
+	if len(data) < 16 || string(data[:8]) != magic {
+		return nil, errors.New("Not a kladr index snapshot")
+	}
+	if binary.LittleEndian.Uint32(data[8:]) != version {
+		return nil, errors.New("Unsupported snapshot version")
+	}
+	count := int(binary.LittleEndian.Uint32(data[12:]))
+	sections := make(map[string][]byte, count)
+	p := 16
+	for i := 0; i < count; i++ {
+		if p+2 > len(data) {
+			return nil, errors.New("Broken snapshot section table")
+		}
+		size := int(binary.LittleEndian.Uint16(data[p:]))
+		p += 2
+		if p+size+16 > len(data) {
+			return nil, errors.New("Broken snapshot section table")
+		}
+		name := string(data[p : p+size])
+		p += size
+		offset := binary.LittleEndian.Uint64(data[p:])
+		length := binary.LittleEndian.Uint64(data[p+8:])
+		p += 16
+		if offset > uint64(len(data)) || length > uint64(len(data))-offset {
+			return nil, errors.New("Broken snapshot section " + name)
+		}
+		sections[name] = data[offset : offset+length]
+	}
+	return sections, nil
+}
+
+// Indices lists the indices stored in the snapshot.
+func (snapshot *Snapshot) Indices() []string {
+	var names []string
+	for name := range snapshot.sections {
+		if strings.HasSuffix(name, "/docs") {
+			names = append(names, strings.TrimSuffix(name, "/docs"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Index returns nil when the snapshot has no such index.
+func (snapshot *Snapshot) Index(name string) *Index {
+	docs, ok := snapshot.sections[name+"/docs"]
+	if !ok {
+		return nil
+	}
+	index := &Index{docs: docs, docsOff: snapshot.sections[name+"/docs.off"], num: make(map[string][]byte), str: make(map[string][2][]byte), terms: make(map[string]*Terms)}
+	for section, data := range snapshot.sections {
+		if !strings.HasPrefix(section, name+"/") || strings.HasSuffix(section, ".off") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(section, name+"/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "num":
+			index.num[parts[1]] = data
+		case "str":
+			index.str[parts[1]] = [2][]byte{data, snapshot.sections[section+".off"]}
+		case "terms":
+			post := name + "/post/" + parts[1]
+			index.terms[parts[1]] = &Terms{tokens: data, tokensOff: snapshot.sections[section+".off"], post: snapshot.sections[post], postOff: snapshot.sections[post+".off"]}
+		}
+	}
+	return index
+}
+
+// check verifies that every offset, column and posting of the index stays inside its section.
+func (index *Index) check() error {
+	if len(index.docsOff) < 8 || len(index.docsOff)%8 != 0 {
+		return errors.New("no document offsets")
+	}
+	count := index.Len()
+	if !checkOffsets(index.docsOff, count, index.docs) {
+		return errors.New("document offsets out of range")
+	}
+	for field, column := range index.num {
+		if len(column) != count*8 {
+			return errors.New("column " + field + " has a wrong length")
+		}
+	}
+	for field, column := range index.str {
+		if !checkOffsets(column[1], count, column[0]) {
+			return errors.New("column " + field + " offsets out of range")
+		}
+	}
+	for field, terms := range index.terms {
+		if len(terms.tokensOff) < 8 || len(terms.tokensOff)%8 != 0 {
+			return errors.New("no token offsets of " + field)
+		}
+		tokens := terms.Len()
+		if !checkOffsets(terms.tokensOff, tokens, terms.tokens) || !checkOffsets(terms.postOff, tokens, terms.post) {
+			return errors.New("terms of " + field + " out of range")
+		}
+		for i := 0; i < tokens; i++ {
+			if (offset(terms.postOff, i+1)-offset(terms.postOff, i))%4 != 0 {
+				return errors.New("postings of " + field + " broken")
+			}
+		}
+		for j := 0; j+4 <= len(terms.post); j += 4 {
+			if int(binary.LittleEndian.Uint32(terms.post[j:])) >= count {
+				return errors.New("postings of " + field + " point past the documents")
+			}
+		}
+	}
+	return nil
+}
+
+// checkOffsets reports whether offsets hold count+1 non-decreasing entries inside data.
+func checkOffsets(offsets []byte, count int, data []byte) bool {
+	if len(offsets) != (count+1)*8 {
+		return false
+	}
+	var last uint64
+	for i := 0; i <= count; i++ {
+		value := offset(offsets, i)
+		if value < last || value > uint64(len(data)) {
+			return false
+		}
+		last = value
+	}
+	return true
+}
+
+func offset(offsets []byte, i int) uint64 {
+	return binary.LittleEndian.Uint64(offsets[i*8:])
+}
+
+func (index *Index) Len() int {
+	if len(index.docsOff) < 8 {
+		return 0
+	}
+	return len(index.docsOff)/8 - 1
+}
+
+// Source is the _source of a document, it points into the mapped file and must not be changed.
+func (index *Index) Source(pos int) []byte {
+	return index.docs[offset(index.docsOff, pos):offset(index.docsOff, pos+1)]
+}
+
+// Fields lists the columns of the index.
+func (index *Index) Fields() []string {
+	var fields []string
+	for field := range index.num {
+		fields = append(fields, field)
+	}
+	for field := range index.str {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Values reads a document's values of a field from the columns: float64 for numbers, string for the rest.
+func (index *Index) Values(pos int, field string) []interface{} {
+	if column, ok := index.num[field]; ok {
+		value := math.Float64frombits(binary.LittleEndian.Uint64(column[pos*8:]))
+		if math.IsNaN(value) {
+			return nil
+		}
+		return []interface{}{value}
+	}
+	column, ok := index.str[field]
+	if !ok {
+		return nil
+	}
+	data := column[0][offset(column[1], pos):offset(column[1], pos+1)]
+	if len(data) == 0 {
+		return nil
+	}
+	var values []interface{}
+	for _, v := range strings.Split(string(data[1:]), "\x00") {
+		values = append(values, v)
+	}
+	return values
+}
+
+// Terms returns nil for a field without a term dictionary.
+func (index *Index) Terms(field string) *Terms {
+	return index.terms[field]
+}
+
+// Match returns the positions of documents having all tokens of the text in the field, as a
+// match query with operator "and" finds them.
+func (index *Index) Match(field string, text string) []int {
+	terms := index.terms[field]
+	tokens := Analyze(text)
+	if terms == nil || len(tokens) == 0 {
+		return nil
+	}
+	var result []int
+	for i, token := range tokens {
+		id, ok := terms.Find(token)
+		if !ok {
+			return nil
+		}
+		if i == 0 {
+			result = terms.Postings(id)
+			continue
+		}
+		result = Intersect(result, terms.Postings(id))
+	}
+	return result
+}
+
+func (terms *Terms) Len() int {
+	if len(terms.tokensOff) < 8 {
+		return 0
+	}
+	return len(terms.tokensOff)/8 - 1
+}
+
+func (terms *Terms) Token(i int) string {
+	return string(terms.tokens[offset(terms.tokensOff, i):offset(terms.tokensOff, i+1)])
+}
+
+func (terms *Terms) Postings(i int) []int {
+	data := terms.post[offset(terms.postOff, i):offset(terms.postOff, i+1)]
+	postings := make([]int, len(data)/4)
+	for j := range postings {
+		postings[j] = int(binary.LittleEndian.Uint32(data[j*4:]))
+	}
+	return postings
+}
+
+func (terms *Terms) Find(token string) (int, bool) {
+	i := sort.Search(terms.Len(), func(i int) bool { return terms.Token(i) >= token })
+	return i, i < terms.Len() && terms.Token(i) == token
+}
+
+// Intersect merges two sorted position lists.
+func Intersect(a []int, b []int) []int {
+	var result []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
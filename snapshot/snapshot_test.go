@@ -0,0 +1,257 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var kladrDocs = []string{
+	`{"doc_id":1,"code":"7200000000000","status":0,"locality_title":"обл","locality_name":"Тюменская","region_code":72}`,
+	`{"doc_id":2,"code":"7200000100000","postcode":"625000","status":2,"locality_title":"г","locality_name":"Тюмень","region_code":72,"alt_codes":["7200000100051","7200000100052"],"ancestors":[{"id":1}]}`,
+	`{"doc_id":3,"code":"7201900006300","status":0,"locality_title":"с","locality_name":"Нижняя Тавда","region_code":72,"location":"57.67,66.17"}`,
+}
+
+var geoDocs = []string{
+	`{"doc_id":1,"start_ip":"10.0.0.0","end_ip":"10.255.255.255","country":"RU","city":"Тюмень","kladr_id":2}`,
+}
+
+func writeIndex(t *testing.T, path string, index string, docs []string) {
+	t.Helper()
+	writer := NewWriter(path, index)
+	for _, doc := range docs {
+		writer.Add([]byte(doc))
+	}
+	if writer.Len() != len(docs) {
+		t.Fatalf("%s: %d documents queued, want %d", index, writer.Len(), len(docs))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempPath(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "kladr.idx"), func() { os.RemoveAll(dir) }
+}
+
+func checkKladr(t *testing.T, index *Index) {
+	t.Helper()
+	if index == nil {
+		t.Fatal("kladr index missing")
+	}
+	if index.Len() != len(kladrDocs) {
+		t.Fatalf("%d documents, want %d", index.Len(), len(kladrDocs))
+	}
+	for pos, doc := range kladrDocs {
+		if string(index.Source(pos)) != doc {
+			t.Errorf("source %d: %s", pos, index.Source(pos))
+		}
+	}
+	values := []struct {
+		pos   int
+		field string
+		want  []interface{}
+	}{
+		{0, "doc_id", []interface{}{1.0}},
+		{1, "region_code", []interface{}{72.0}},
+		{1, "postcode", []interface{}{"625000"}},
+		{0, "postcode", nil},
+		{1, "alt_codes", []interface{}{"7200000100051", "7200000100052"}},
+		{2, "location", []interface{}{"57.67,66.17"}},
+		{1, "ancestors", nil},
+		{0, "missing", nil},
+	}
+	for _, v := range values {
+		if got := index.Values(v.pos, v.field); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("values %d %s: %v, want %v", v.pos, v.field, got, v.want)
+		}
+	}
+	terms := index.Terms("locality_name")
+	if terms == nil {
+		t.Fatal("no terms of locality_name")
+	}
+	var tokens []string
+	for i := 0; i < terms.Len(); i++ {
+		tokens = append(tokens, terms.Token(i))
+	}
+	if want := []string{"нижняя", "тавда", "тюменская", "тюмень"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("tokens %v, want %v", tokens, want)
+	}
+	if i, ok := terms.Find("тюмень"); !ok || !reflect.DeepEqual(terms.Postings(i), []int{1}) {
+		t.Errorf("тюмень: %d %v", i, ok)
+	}
+	if _, ok := terms.Find("тюм"); ok {
+		t.Error("prefix found as a token")
+	}
+	// keywords keep the value as it is, numbers as they are written
+	if i, ok := index.Terms("alt_codes").Find("7200000100052"); !ok || !reflect.DeepEqual(index.Terms("alt_codes").Postings(i), []int{1}) {
+		t.Error("alt_codes term missing")
+	}
+	if _, ok := index.Terms("doc_id").Find("3"); !ok {
+		t.Error("doc_id term missing")
+	}
+	if index.Terms("region_code") != nil {
+		t.Error("region_code has no term dictionary")
+	}
+	matches := []struct {
+		field string
+		text  string
+		want  []int
+	}{
+		{"locality_name", "Нижняя Тавда", []int{2}},
+		{"locality_name", "тавда нижняя", []int{2}},
+		{"locality_name", "нижняя тюмень", nil},
+		{"locality_name", "тюмень", []int{1}},
+		{"region_code", "72", nil},
+	}
+	for _, v := range matches {
+		if got := index.Match(v.field, v.text); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("match %s %q: %v, want %v", v.field, v.text, got, v.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	writeIndex(t, path, "kladr", kladrDocs)
+	snapshot, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if !reflect.DeepEqual(snapshot.Indices(), []string{"kladr"}) {
+		t.Errorf("indices %v", snapshot.Indices())
+	}
+	if snapshot.Index("geoip") != nil {
+		t.Error("geoip index without documents")
+	}
+	checkKladr(t, snapshot.Index("kladr"))
+}
+
+func TestWriterKeepsOtherIndices(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	writeIndex(t, path, "kladr", kladrDocs)
+	writeIndex(t, path, "geoip", geoDocs)
+	// a second run of the geo import replaces only its own sections
+	writeIndex(t, path, "geoip", geoDocs)
+	snapshot, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if !reflect.DeepEqual(snapshot.Indices(), []string{"geoip", "kladr"}) {
+		t.Errorf("indices %v", snapshot.Indices())
+	}
+	checkKladr(t, snapshot.Index("kladr"))
+	geo := snapshot.Index("geoip")
+	if geo.Len() != 1 || string(geo.Source(0)) != geoDocs[0] {
+		t.Errorf("geoip: %d documents", geo.Len())
+	}
+	if got := geo.Values(0, "start_ip"); !reflect.DeepEqual(got, []interface{}{"10.0.0.0"}) {
+		t.Errorf("start_ip %v", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	var sources [][]byte
+	for _, doc := range kladrDocs {
+		sources = append(sources, []byte(doc))
+	}
+	index, err := Build(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKladr(t, index)
+	if _, err := Build([][]byte{[]byte(`{"doc_id":`)}); err == nil {
+		t.Error("broken document accepted")
+	}
+}
+
+func TestOpenRejectsOtherFiles(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(path, []byte("not a snapshot file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := Open(path); err == nil {
+		snapshot.Close()
+		t.Error("file without the magic opened")
+	}
+}
+
+func TestOpenRejectsTruncatedFile(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	writeIndex(t, path, "kladr", kladrDocs)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data[:len(data)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := Open(path); err == nil {
+		snapshot.Close()
+		t.Error("truncated file opened")
+	}
+}
+
+func TestCheckRejectsBrokenOffsets(t *testing.T) {
+	var sources [][]byte
+	for _, doc := range kladrDocs {
+		sources = append(sources, []byte(doc))
+	}
+	broken := []func(index *Index){
+		func(index *Index) {
+			index.docsOff = append([]byte(nil), index.docsOff...)
+			binary.LittleEndian.PutUint64(index.docsOff[8:], 1<<40)
+		},
+		func(index *Index) {
+			index.docsOff = index.docsOff[:len(index.docsOff)-3]
+		},
+		func(index *Index) {
+			index.num["region_code"] = index.num["region_code"][:8]
+		},
+		func(index *Index) {
+			column := index.str["postcode"]
+			index.str["postcode"] = [2][]byte{column[0][:0], column[1]}
+		},
+		func(index *Index) {
+			terms := index.terms["locality_name"]
+			terms.post = append([]byte(nil), terms.post...)
+			binary.LittleEndian.PutUint32(terms.post, 7)
+		},
+	}
+	for i, breakIndex := range broken {
+		index, err := Build(sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.check(); err != nil {
+			t.Fatalf("%d: valid index rejected: %v", i, err)
+		}
+		breakIndex(index)
+		if index.check() == nil {
+			t.Errorf("%d: broken index accepted", i)
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	if got := Intersect([]int{1, 3, 5, 7}, []int{2, 3, 7, 8}); !reflect.DeepEqual(got, []int{3, 7}) {
+		t.Errorf("intersect %v", got)
+	}
+}
@@ -0,0 +1,258 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Writer collects the documents of one index and stores them in the snapshot file on Close,
+// other indices already in the file are kept, so the kladr and geo importers can fill one file.
+type Writer struct {
+	path  string
+	index string
+	docs  [][]byte
+}
+
+func NewWriter(path string, index string) *Writer {
+	return &Writer{path: path, index: index}
+}
+
+// Add takes the _source of a document as it would be sent to Elasticsearch.
+func (writer *Writer) Add(source []byte) {
+	writer.docs = append(writer.docs, append([]byte(nil), source...))
+}
+
+func (writer *Writer) Len() int {
+	return len(writer.docs)
+}
+
+func (writer *Writer) Close() error {
+	sections := make(map[string][]byte)
+	data, err := ioutil.ReadFile(writer.path)
+	if err == nil {
+		old, err := readSections(data)
+		if err != nil {
+			return err
+		}
+		for name, v := range old {
+			if !strings.HasPrefix(name, writer.index+"/") {
+				sections[name] = v
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err = writer.build(sections); err != nil {
+		return err
+	}
+	return writeSections(writer.path, sections)
+}
+
+// Build makes an index in memory without a file, the JSONL dumps of the in-memory backend are
+// loaded with it.
+func Build(sources [][]byte) (*Index, error) {
+	writer := &Writer{index: "memory", docs: sources}
+	sections := make(map[string][]byte)
+	if err := writer.build(sections); err != nil {
+		return nil, err
+	}
+	return (&Snapshot{sections: sections}).Index(writer.index), nil
+}
+
+func (writer *Writer) build(sections map[string][]byte) error {
+	prefix := writer.index + "/"
+	values := make([]map[string]interface{}, len(writer.docs))
+	numeric := make(map[string]bool)
+	var docs bytes.Buffer
+	var docsOff []uint64
+	for pos, source := range writer.docs {
+		docsOff = append(docsOff, uint64(docs.Len()))
+		docs.Write(source)
+		if err := json.Unmarshal(source, &values[pos]); err != nil {
+			return fmt.Errorf("Document %d of %s: %v", pos, writer.index, err)
+		}
+		// a field is a number column only when every document has a single number in it
+		for field, value := range values[pos] {
+			list := scalars(value)
+			if len(list) == 0 {
+				continue
+			}
+			_, isNumber := list[0].(float64)
+			wasNumber, seen := numeric[field]
+			numeric[field] = isNumber && len(list) == 1 && (wasNumber || !seen)
+		}
+	}
+	docsOff = append(docsOff, uint64(docs.Len()))
+	sections[prefix+"docs"] = docs.Bytes()
+	sections[prefix+"docs.off"] = encodeOffsets(docsOff)
+	for field, isNumber := range numeric {
+		if isNumber {
+			column := make([]byte, 8*len(values))
+			for pos := range values {
+				value := math.NaN()
+				if list := scalars(values[pos][field]); len(list) > 0 {
+					value = list[0].(float64)
+				}
+				binary.LittleEndian.PutUint64(column[pos*8:], math.Float64bits(value))
+			}
+			sections[prefix+"num/"+field] = column
+		} else {
+			var column bytes.Buffer
+			var columnOff []uint64
+			for pos := range values {
+				columnOff = append(columnOff, uint64(column.Len()))
+				list := scalars(values[pos][field])
+				if len(list) == 0 {
+					continue
+				}
+				column.WriteByte(1)
+				for i, v := range list {
+					if i > 0 {
+						column.WriteByte(0)
+					}
+					column.WriteString(format(v))
+				}
+			}
+			columnOff = append(columnOff, uint64(column.Len()))
+			sections[prefix+"str/"+field] = column.Bytes()
+			sections[prefix+"str/"+field+".off"] = encodeOffsets(columnOff)
+		}
+		if TextFields[field] || KeyFields[field] {
+			writer.buildTerms(sections, prefix, field, values)
+		}
+	}
+	return nil
+}
+
+func (writer *Writer) buildTerms(sections map[string][]byte, prefix string, field string, values []map[string]interface{}) {
+	postings := make(map[string][]int)
+	for pos := range values {
+		for _, v := range scalars(values[pos][field]) {
+			tokens := []string{format(v)}
+			if TextFields[field] {
+				tokens = Analyze(tokens[0])
+			}
+			for _, token := range tokens {
+				if list := postings[token]; len(list) == 0 || list[len(list)-1] != pos {
+					postings[token] = append(list, pos)
+				}
+			}
+		}
+	}
+	var tokens []string
+	for token := range postings {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	var terms, post bytes.Buffer
+	var termsOff, postOff []uint64
+	buf := make([]byte, 4)
+	for _, token := range tokens {
+		termsOff = append(termsOff, uint64(terms.Len()))
+		terms.WriteString(token)
+		postOff = append(postOff, uint64(post.Len()))
+		for _, pos := range postings[token] {
+			binary.LittleEndian.PutUint32(buf, uint32(pos))
+			post.Write(buf)
+		}
+	}
+	termsOff = append(termsOff, uint64(terms.Len()))
+	postOff = append(postOff, uint64(post.Len()))
+	sections[prefix+"terms/"+field] = terms.Bytes()
+	sections[prefix+"terms/"+field+".off"] = encodeOffsets(termsOff)
+	sections[prefix+"post/"+field] = post.Bytes()
+	sections[prefix+"post/"+field+".off"] = encodeOffsets(postOff)
+}
+
+// scalars flattens a value to numbers and strings, objects like ancestors stay in _source only.
+func scalars(value interface{}) []interface{} {
+	list, ok := value.([]interface{})
+	if !ok {
+		list = []interface{}{value}
+	}
+	var result []interface{}
+	for _, v := range list {
+		switch s := v.(type) {
+		case string, float64:
+			result = append(result, s)
+		case bool:
+			result = append(result, strconv.FormatBool(s))
+		}
+	}
+	return result
+}
+
+func format(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return v.(string)
+}
+
+func encodeOffsets(offsets []uint64) []byte {
+	data := make([]byte, 8*len(offsets))
+	for i, v := range offsets {
+		binary.LittleEndian.PutUint64(data[i*8:], v)
+	}
+	return data
+}
+
+// writeSections writes to a temporary file first, a running service keeps its mapping of the old one.
+func writeSections(path string, sections map[string][]byte) error {
+	var names []string
+	size := 16
+	for name := range sections {
+		names = append(names, name)
+		size += 2 + len(name) + 16
+	}
+	sort.Strings(names)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(file, 1<<20)
+	header := make([]byte, 16, size)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[8:], version)
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(names)))
+	offset := uint64(align(size))
+	buf := make([]byte, 8)
+	for _, name := range names {
+		binary.LittleEndian.PutUint16(buf, uint16(len(name)))
+		header = append(header, buf[:2]...)
+		header = append(header, name...)
+		binary.LittleEndian.PutUint64(buf, offset)
+		header = append(header, buf...)
+		binary.LittleEndian.PutUint64(buf, uint64(len(sections[name])))
+		header = append(header, buf...)
+		offset += uint64(align(len(sections[name])))
+	}
+	w.Write(header)
+	w.Write(make([]byte, align(size)-size))
+	for _, name := range names {
+		w.Write(sections[name])
+		w.Write(make([]byte, align(len(sections[name]))-len(sections[name])))
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// align keeps every section on an 8 byte boundary of the mapped file.
+func align(n int) int {
+	return (n + 7) &^ 7
+}
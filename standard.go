@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fastjson"
+)
+
+type standardDate struct {
+	Postcode   string `json:"postcode,omitempty"`
+	Region     string `json:"region,omitempty"`
+	District   string `json:"district,omitempty"`
+	Locality   string `json:"locality,omitempty"`
+	Street     string `json:"street,omitempty"`
+	House      string `json:"house,omitempty"`
+	Flat       string `json:"flat,omitempty"`
+	Address    string `json:"address"`
+	Key        string `json:"key"`
+	LocalityID int    `json:"locality_id,omitempty"`
+	StreetID   int    `json:"street_id,omitempty"`
+	short      [4]string
+}
+
+// Types written after the name in a postal address: "Тюменская обл.", "Тюменский р-н".
+var suffixTypes = []string{"обл", "край", "АО", "Аобл", "р-н"}
+
+// typeNames gives the full name of a whole abbreviation, so "пгт" is not replaced piece by piece.
+// An abbreviation missing here and in streetTypes stays abbreviated.
+var typeNames = abbrNames(localityTypes, []string{
+	"р-н", "район", "край", "край", "Аобл", "автономная область", "пгт", "поселок городского типа",
+	"рп", "рабочий поселок", "кп", "курортный поселок", "дп", "дачный поселок", "ст-ца", "станица",
+	"аул", "аул", "м", "местечко", "у", "улус", "ст", "станция", "мкр", "микрорайон", "тер", "территория",
+})
+
+func getAddressStandard(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	var standardDate standardDate
+	var found bool
+	var err error
+	expand := string(ctx.QueryArgs().Peek("expand")) == "1"
+	house := string(ctx.QueryArgs().Peek("house"))
+	flat := string(ctx.QueryArgs().Peek("flat"))
+	localityID := string(ctx.QueryArgs().Peek("locality_id"))
+	streetID := string(ctx.QueryArgs().Peek("street_id"))
+	matchedLID, _ := regexp.MatchString(`^\d+$`, localityID)
+	matchedSID, _ := regexp.MatchString(`^\d+$`, streetID)
+	lid, errLID := strconv.Atoi(localityID)
+	sid, errSID := strconv.Atoi(streetID)
+	if len(ctx.QueryArgs().Peek("address")) > 0 {
+		standardDate, found, err = standardFromParsed(string(ctx.QueryArgs().Peek("address")), expand)
+	} else if matchedLID && errLID == nil {
+		standardDate, found, err = standardFromID(lid, sid, matchedSID && errSID == nil, house, flat, expand)
+	}
+	if err != nil {
+		searchFailed(ctx, err)
+		return
+	}
+	log.Print("Remoote IP: ", ctx.RemoteIP(), "; Query ARGS: ", ctx.Request.URI().QueryArgs(), "; Found: ", found, "; Time Spent: ", time.Since(start))
+	if !found {
+		ctx.Error("not found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.Response.Header.Set("Content-Type", "application/json")
+	body, err := json.Marshal(standardDate)
+	if err != nil {
+		log.Print(err)
+		sentry.CaptureException(err)
+	}
+	fmt.Fprint(ctx, string(body))
+}
+
+func standardFromID(localityID int, streetID int, withStreet bool, house string, flat string, expand bool) (standardDate, bool, error) {
+	var standardDate standardDate
+	resp, err := sendRequest(indexKladr, queryByID(localityID))
+	if err != nil {
+		return standardDate, false, err
+	}
+	docDates := resultByIDFromHits(resp)
+	if len(docDates) == 0 {
+		return standardDate, false, nil
+	}
+	locality := docDates[0]
+	standardDate.LocalityID = locality.ID
+	standardDate.Postcode = locality.Postcode
+	regionTypes, districtTypes, err := levelTypes()
+	if err != nil {
+		return standardDate, false, err
+	}
+	for _, v := range locality.Ancestors {
+		switch {
+		case containsType(regionTypes, v.Type) || len(standardDate.Region) == 0 && v.ID == regionID(locality):
+			standardDate.setPart(0, v.Name, v.Type, expand)
+		case containsType(districtTypes, v.Type):
+			standardDate.setPart(1, v.Name, v.Type, expand)
+		}
+	}
+	standardDate.setPart(2, locality.LocalityType.LocalityName, knownType(locality.LocalityType.LocalityTitle), expand)
+	if withStreet {
+		resp, err := sendRequest(indexStreet, queryByID(streetID))
+		if err != nil {
+			return standardDate, false, err
+		}
+		streetDates := resultStreetFromHits(resp)
+		if len(streetDates) > 0 && (streetDates[0].Locality == nil || streetDates[0].Locality.(streetLocality).LocalityID == locality.ID) {
+			street := streetDates[0]
+			standardDate.StreetID = street.ID
+			standardDate.setPart(3, street.StreetType.LocalityName, knownType(street.StreetType.LocalityTitle), expand)
+			if len(house) > 0 {
+				resp, err := sendRequest(indexHouse, queryHouse(street.ID))
+				if err != nil {
+					return standardDate, false, err
+				}
+				for _, hit := range resp.Hits.Hits {
+					if matchHouseBlock(fastjson.GetString(hit.Source, "houses"), fastjson.GetString(hit.Source, "korp"), house) && len(fastjson.GetString(hit.Source, "postcode")) > 0 {
+						standardDate.Postcode = fastjson.GetString(hit.Source, "postcode")
+						break
+					}
+				}
+			}
+		}
+	}
+	if len(house) > 0 {
+		standardDate.House = standardNumber(normalizeHouse(house), "д", houseNames, expand)
+	}
+	if len(flat) > 0 {
+		standardDate.Flat = standardNumber(strings.TrimSpace(flat), "кв", flatNames, expand)
+	}
+	standardDate.Address = standardAddress(standardDate)
+	standardDate.Key = standardKey(standardDate, house, flat)
+	return standardDate, true, nil
+}
+
+func standardFromParsed(address string, expand bool) (standardDate, bool, error) {
+	addressDate, err := parseAddress(address)
+	if err != nil {
+		return standardDate{}, false, err
+	}
+	if addressDate.Locality != nil && addressDate.Locality.ID != 0 {
+		var house, flat string
+		var streetID int
+		if addressDate.House != nil {
+			house = addressDate.House.Value
+			if addressDate.Building != nil {
+				house = house + addressDate.Building.Type + addressDate.Building.Value
+			}
+		}
+		if addressDate.Flat != nil {
+			flat = addressDate.Flat.Value
+		}
+		if addressDate.Street != nil && addressDate.Street.ID != 0 {
+			streetID = addressDate.Street.ID
+		}
+		standardDate, found, err := standardFromID(addressDate.Locality.ID, streetID, streetID != 0, house, flat, expand)
+		if err != nil {
+			return standardDate, false, err
+		}
+		if found {
+			if len(standardDate.Street) == 0 && addressDate.Street != nil {
+				standardDate.setPart(3, addressDate.Street.Value, addressDate.Street.Type, expand)
+				standardDate.Address = standardAddress(standardDate)
+				standardDate.Key = standardKey(standardDate, house, flat)
+			}
+			if addressDate.Postcode != nil && addressDate.Postcode.Confidence == 1 && len(standardDate.Postcode) == 0 {
+				standardDate.Postcode = addressDate.Postcode.Value
+				standardDate.Address = standardAddress(standardDate)
+			}
+			return standardDate, true, nil
+		}
+	}
+	var standardDate standardDate
+	found := false
+	for i, part := range []*addressPart{addressDate.Region, addressDate.District, addressDate.Locality, addressDate.Street} {
+		if part != nil {
+			standardDate.setPart(i, part.Value, part.Type, expand)
+			found = true
+		}
+	}
+	var house, flat string
+	if addressDate.Postcode != nil {
+		standardDate.Postcode = addressDate.Postcode.Value
+	}
+	if addressDate.House != nil {
+		house = addressDate.House.Value
+		if addressDate.Building != nil {
+			house = house + addressDate.Building.Type + addressDate.Building.Value
+		}
+		standardDate.House = standardNumber(normalizeHouse(house), "д", houseNames, expand)
+	}
+	if addressDate.Flat != nil {
+		flat = addressDate.Flat.Value
+		standardDate.Flat = standardNumber(flat, "кв", flatNames, expand)
+	}
+	standardDate.Address = standardAddress(standardDate)
+	standardDate.Key = standardKey(standardDate, house, flat)
+	return standardDate, found, nil
+}
+
+// setPart fills region, district, locality or street (0-3) and keeps the abbreviated form for the key.
+func (standardDate *standardDate) setPart(i int, name string, abbr string, expand bool) {
+	fields := []*string{&standardDate.Region, &standardDate.District, &standardDate.Locality, &standardDate.Street}
+	*fields[i] = standardPart(name, abbr, expand)
+	standardDate.short[i] = standardPart(name, abbr, false)
+}
+
+func regionID(locality docDate) int {
+	if region, ok := locality.Region.(region); ok {
+		return region.RegionID
+	}
+	return 0
+}
+
+// standardPart writes a component with a postal abbreviation ("г. Тюмень", "Тюменская обл.", "пр-кт Мира")
+// or with the full type name when expand is set ("город Тюмень", "Тюменская область"). A name that
+// already carries its type ("Ханты-Мансийский Автономный округ - Югра") is written as it is.
+func standardPart(name string, abbr string, expand bool) string {
+	if len(abbr) == 0 {
+		return name
+	}
+	typeName := abbr
+	fullName, known := typeNames[abbr]
+	if street, ok := streetTypes[abbr]; ok {
+		fullName, known = street, true
+	}
+	if nameHasType(name, abbr, fullName) {
+		return name
+	}
+	if expand && known {
+		typeName = fullName
+	} else if known && fullName != abbr && !strings.ContainsAny(abbr, "-/") && abbr != strings.ToUpper(abbr) {
+		// only a known shortening gets the dot, "край" or an unknown type is a whole word
+		typeName = abbr + "."
+	}
+	if containsType(suffixTypes, abbr) {
+		return name + " " + typeName
+	}
+	return typeName + " " + name
+}
+
+// nameHasType reports whether the words of the name hold the type, by its full name or by an
+// abbreviation longer than a letter ("Чувашская Республика - Чувашия", "Ненецкий АО").
+func nameHasType(name string, abbr string, fullName string) bool {
+	words := " " + strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '-' && r != '/'
+	}), " ") + " "
+	if len(fullName) > 0 && strings.Contains(words, " "+strings.ToLower(fullName)+" ") {
+		return true
+	}
+	return utf8.RuneCountInString(abbr) > 1 && strings.Contains(words, " "+strings.ToLower(abbr)+" ")
+}
+
+// abbrNames maps the abbreviations of lists of (abbreviation, full name) pairs to the full names.
+func abbrNames(lists ...[]string) map[string]string {
+	names := make(map[string]string)
+	for _, pairs := range lists {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			names[pairs[i]] = pairs[i+1]
+		}
+	}
+	return names
+}
+
+func standardNumber(value string, abbr string, types map[string]string, expand bool) string {
+	if expand {
+		return types[abbr] + " " + value
+	}
+	return abbr + ". " + value
+}
+
+// standardAddress follows the Russian Post order: street, house, flat, locality, district, region, postcode.
+func standardAddress(standardDate standardDate) string {
+	var parts []string
+	for _, v := range []string{standardDate.Street, standardDate.House, standardDate.Flat, standardDate.Locality, standardDate.District, standardDate.Region, standardDate.Postcode} {
+		if len(v) > 0 {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// standardKey is stable for the same address regardless of the input shape, ids win over names.
+func standardKey(standardDate standardDate, house string, flat string) string {
+	var parts []string
+	if standardDate.LocalityID != 0 {
+		parts = append(parts, "l"+strconv.Itoa(standardDate.LocalityID))
+	} else {
+		parts = append(parts, standardDate.short[0], standardDate.short[1], standardDate.short[2])
+	}
+	if standardDate.StreetID != 0 {
+		parts = append(parts, "s"+strconv.Itoa(standardDate.StreetID))
+	} else {
+		parts = append(parts, standardDate.short[3])
+	}
+	parts = append(parts, normalizeHouse(house), normalizeHouse(flat))
+	key := strings.Replace(strings.ToLower(strings.Join(parts, "|")), "ё", "е", -1)
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestStandardPart(t *testing.T) {
+	tests := []struct {
+		name   string
+		abbr   string
+		expand bool
+		want   string
+	}{
+		{"Тюмень", "г", false, "г. Тюмень"},
+		{"Тюмень", "г", true, "город Тюмень"},
+		{"Тюменская", "обл", false, "Тюменская обл."},
+		{"Тюменская", "обл", true, "Тюменская область"},
+		{"Тюменский", "р-н", true, "Тюменский район"},
+		{"Боровский", "пгт", false, "пгт. Боровский"},
+		// the whole abbreviation is looked up, "пгт" must not become "поселокгородт"
+		{"Боровский", "пгт", true, "поселок городского типа Боровский"},
+		// a name with its type inside is not given the type again
+		{"Ханты-Мансийский Автономный округ - Югра", "АО", true, "Ханты-Мансийский Автономный округ - Югра"},
+		{"Ханты-Мансийский Автономный округ - Югра", "АО", false, "Ханты-Мансийский Автономный округ - Югра"},
+		{"Чувашская Республика - Чувашия", "Респ", false, "Чувашская Республика - Чувашия"},
+		{"Ненецкий", "АО", false, "Ненецкий АО"},
+		{"Ненецкий", "АО", true, "Ненецкий автономный округ"},
+		{"Мира", "пр-кт", true, "проспект Мира"},
+		{"Березка", "снт", true, "садовое некоммерческое товарищество Березка"},
+		// an unknown type stays as it is and a whole word gets no dot
+		{"Лесной", "жилрайон", true, "жилрайон Лесной"},
+		{"Лесной", "жилрайон", false, "жилрайон Лесной"},
+		{"Алтайский", "край", false, "Алтайский край"},
+		{"Заречный", "мкр", false, "мкр. Заречный"},
+		{"Тюмень", "", true, "Тюмень"},
+	}
+	for _, test := range tests {
+		if got := standardPart(test.name, test.abbr, test.expand); got != test.want {
+			t.Errorf("standardPart(%q, %q, %v) = %q, want %q", test.name, test.abbr, test.expand, got, test.want)
+		}
+	}
+}
+
+func TestFullTypeName(t *testing.T) {
+	tests := map[string]string{
+		"пгт":      "поселок городского типа",
+		"р-н":      "район",
+		"мкр":      "микрорайон",
+		"г":        "город",
+		"ул":       "улица",
+		"жилрайон": "жилрайон",
+	}
+	for abbr, want := range tests {
+		if got := fullTypeName(abbr); got != want {
+			t.Errorf("fullTypeName(%q) = %q, want %q", abbr, got, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var translitAlphabet = []rune("абвгдеёжзийклмнопрстуфхцчшщъыьэюя")
+
+var translitSchemes = map[string][]string{
+	"icao": {"a", "b", "v", "g", "d", "e", "e", "zh", "z", "i", "i", "k", "l", "m", "n", "o", "p", "r", "s", "t", "u", "f", "kh", "ts", "ch", "sh", "shch", "ie", "y", "", "e", "iu", "ia"},
+	"gost": {"a", "b", "v", "g", "d", "e", "yo", "zh", "z", "i", "j", "k", "l", "m", "n", "o", "p", "r", "s", "t", "u", "f", "x", "cz", "ch", "sh", "shh", "``", "y'", "`", "e`", "yu", "ya"},
+	"bgn":  {"a", "b", "v", "g", "d", "e", "yo", "zh", "z", "i", "y", "k", "l", "m", "n", "o", "p", "r", "s", "t", "u", "f", "kh", "ts", "ch", "sh", "shch", "\"", "y", "'", "e", "yu", "ya"},
+}
+
+// Spellings that are common in the wild but can't be derived by reversing a scheme.
+var translitExtra = map[string]map[string]string{
+	"gost": {"c": "ц", "h": "х"},
+	"bgn":  {"ye": "е", "h": "х", "iy": "ий", "yy": "ый", "j": "й"},
+}
+
+var (
+	translitOrder   = []string{"icao", "gost", "bgn"}
+	translitReverse = make(map[string]map[string]string)
+	translitInput   = regexp.MustCompile("^[a-z'`\"\\s-]*[a-z][a-z'`\"\\s-]*$")
+	translitLatin   = regexp.MustCompile(`[a-z]`)
+)
+
+func init() {
+	for name, scheme := range translitSchemes {
+		reverse := make(map[string]string)
+		for i, latin := range scheme {
+			if _, ok := reverse[latin]; !ok && len(latin) > 0 {
+				reverse[latin] = string(translitAlphabet[i])
+			}
+		}
+		for latin, cyrillic := range translitExtra[name] {
+			reverse[latin] = cyrillic
+		}
+		translitReverse[name] = reverse
+	}
+}
+
+// translitVariants reads a Latin term with every known scheme: "tyumen" -> "тюмен", "nizhniy" -> "нижний".
+func translitVariants(a string) []string {
+	if !translitInput.MatchString(a) {
+		return nil
+	}
+	var variants []string
+	seen := make(map[string]bool)
+	for _, name := range translitOrder {
+		reverse := translitReverse[name]
+		var sb strings.Builder
+		for i := 0; i < len(a); {
+			matched := false
+			for l := 4; l > 0; l-- {
+				if i+l > len(a) {
+					continue
+				}
+				if cyrillic, ok := reverse[a[i:i+l]]; ok {
+					sb.WriteString(cyrillic)
+					i += l
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				if !strings.ContainsRune("'`\"", rune(a[i])) {
+					sb.WriteByte(a[i])
+				}
+				i++
+			}
+		}
+		variant := sb.String()
+		if !seen[variant] && !translitLatin.MatchString(variant) {
+			seen[variant] = true
+			variants = append(variants, variant)
+		}
+	}
+	return variants
+}
+
+// translitTitle romanizes a Cyrillic title, scheme is one of icao, gost or bgn.
+func translitTitle(a string, scheme string) string {
+	table, ok := translitSchemes[scheme]
+	if !ok {
+		table = translitSchemes["icao"]
+	}
+	runes := []rune(a)
+	var sb strings.Builder
+	for i, r := range runes {
+		lower := unicode.ToLower(r)
+		latin := string(r)
+		for j, c := range translitAlphabet {
+			if c == lower {
+				latin = table[j]
+				break
+			}
+		}
+		if scheme == "gost" && lower == 'ц' && i+1 < len(runes) && strings.ContainsRune("еиыйЕИЫЙ", runes[i+1]) {
+			latin = "c"
+		}
+		if r != lower && len(latin) > 0 {
+			upper := i+1 < len(runes) && unicode.IsUpper(runes[i+1])
+			if upper {
+				latin = strings.ToUpper(latin)
+			} else {
+				latin = strings.ToUpper(latin[:1]) + latin[1:]
+			}
+		}
+		sb.WriteString(latin)
+	}
+	return sb.String()
+}